@@ -0,0 +1,116 @@
+// capabilities.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// stCapabilities holds the parts of the REST API which depend on the version of Syncthing
+type stCapabilities struct {
+	Version       string
+	EventsFilter  bool // /rest/events accepts an events parameter
+	ConfigFolders bool // /rest/config/folders lists the folders
+	FSWatcher     bool // Syncthing can watch folders for changes itself (fsWatcherEnabled)
+}
+
+// Versions of Syncthing which introduced the capabilities
+var (
+	minSTVersion           = stVersion{0, 12, 0} // Multiple subs and next on /rest/db/scan
+	eventsFilterSTVersion  = stVersion{0, 14, 0}
+	fsWatcherSTVersion     = stVersion{0, 14, 40}
+	configFoldersSTVersion = stVersion{1, 12, 0}
+)
+
+// stVersion is the major, minor and patch number of a Syncthing version
+type stVersion [3]int
+
+// parseSTVersion parses versions like "v0.14.40", "v1.12.0-rc.1" or "v1.2.3+dev"
+func parseSTVersion(s string) (stVersion, error) {
+	var v stVersion
+	fields := strings.SplitN(strings.TrimPrefix(s, "v"), ".", 3)
+	if len(fields) != 3 {
+		return v, errors.New("invalid version " + s)
+	}
+	// Strip pre-release and build information
+	if i := strings.IndexAny(fields[2], "-+"); i >= 0 {
+		fields[2] = fields[2][:i]
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return v, errors.New("invalid version " + s)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func (v stVersion) atLeast(min stVersion) bool {
+	for i := range v {
+		if v[i] != min[i] {
+			return v[i] > min[i]
+		}
+	}
+	return true
+}
+
+func (v stVersion) String() string {
+	return fmt.Sprintf("v%d.%d.%d", v[0], v[1], v[2])
+}
+
+// capabilitiesFor returns the capabilities of a Syncthing version. Development builds
+// without a proper version are assumed to support everything.
+func capabilitiesFor(version string) (stCapabilities, error) {
+	c := stCapabilities{Version: version}
+	v, err := parseSTVersion(version)
+	if err != nil {
+		Warning.Println("Unknown Syncthing version "+version+", assuming it is recent:", err)
+		v = configFoldersSTVersion
+	}
+	if !v.atLeast(minSTVersion) {
+		return c, fmt.Errorf("Syncthing %s is not supported, please upgrade to %v or later", version, minSTVersion)
+	}
+	c.EventsFilter = v.atLeast(eventsFilterSTVersion)
+	c.FSWatcher = v.atLeast(fsWatcherSTVersion)
+	c.ConfigFolders = v.atLeast(configFoldersSTVersion)
+	return c, nil
+}
+
+// getCapabilities asks Syncthing for its version and returns its capabilities
+func (st *stInstance) getCapabilities() (stCapabilities, error) {
+	Trace.Println("Getting version of " + st.String())
+	r, err := http.NewRequest("GET", st.target+"/rest/system/version", nil)
+	res, err := st.performRequest(r)
+	defer closeRequestResult(res)
+	if err != nil {
+		return stCapabilities{}, fmt.Errorf("Failed to get the version of Syncthing: %v", err)
+	}
+	if res.StatusCode != 200 {
+		return stCapabilities{}, fmt.Errorf("Status %d != 200 for GET /rest/system/version, Syncthing is probably too old", res.StatusCode)
+	}
+	var version struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&version); err != nil {
+		return stCapabilities{}, fmt.Errorf("Failed to get the version of Syncthing: %v", err)
+	}
+	return capabilitiesFor(version.Version)
+}
+
+// stEventTypes are the Syncthing events handled by watchSTEvents
+var stEventTypes = []string{"RemoteIndexUpdated", "ItemStarted", "ItemFinished", "StateChanged", "FolderPaused", "FolderResumed",
+	"FolderScanProgress", "ConfigSaved"}
+
+// eventsQuery returns the query for /rest/events with the given parameters, limited to
+// stEventTypes if Syncthing supports filtering events
+func (st *stInstance) eventsQuery(params string) string {
+	if st.capabilities.EventsFilter {
+		return params + "&events=" + strings.Join(stEventTypes, ",")
+	}
+	return params
+}
@@ -0,0 +1,59 @@
+// capabilities_test.go
+package main
+
+import (
+	"testing"
+)
+
+func TestCapabilitiesFor(t *testing.T) {
+	cases := []struct {
+		version string
+		caps    stCapabilities
+		err     bool
+	}{
+		{"v0.11.26", stCapabilities{}, true},
+		{"v0.12.0", stCapabilities{}, false},
+		{"v0.14.39", stCapabilities{EventsFilter: true}, false},
+		{"v0.14.40-rc.1", stCapabilities{EventsFilter: true, FSWatcher: true}, false},
+		{"v1.11.1", stCapabilities{EventsFilter: true, FSWatcher: true}, false},
+		{"v1.12.0", stCapabilities{EventsFilter: true, FSWatcher: true, ConfigFolders: true}, false},
+		{"v2.0.0+dev", stCapabilities{EventsFilter: true, FSWatcher: true, ConfigFolders: true}, false},
+		{"unknown-dev", stCapabilities{EventsFilter: true, FSWatcher: true, ConfigFolders: true}, false},
+	}
+	for _, c := range cases {
+		caps, err := capabilitiesFor(c.version)
+		c.caps.Version = c.version
+		if (err != nil) != c.err || err == nil && caps != c.caps {
+			t.Errorf("%s: expected %+v (error %t), got %+v (%v)", c.version, c.caps, c.err, caps, err)
+		}
+	}
+}
+
+func TestGetCapabilities(t *testing.T) {
+	st := newFakeSyncthing(FolderConfiguration{ID: "id1", Label: "Label", Path: "/a"})
+	defer st.use()()
+	st.version = "v1.12.0"
+	var err error
+	st.inst.capabilities, err = st.inst.getCapabilities()
+	if caps := st.inst.capabilities; err != nil || caps.Version != "v1.12.0" || !caps.ConfigFolders {
+		t.Fatalf("Invalid capabilities %+v (%v)", caps, err)
+	}
+	if folders, err := st.inst.getFolders(); err != nil || len(folders) != 1 || folders[0].ID != "id1" || folders[0].Path != "/a" {
+		t.Errorf("Invalid folders from /rest/config/folders: %#v (%v)", folders, err)
+	}
+	// Only handled events are requested
+	st.addEvent("Starting", nil)
+	id := st.addEvent("ItemStarted", map[string]interface{}{"folder": "id1", "item": "a"})
+	st.addEvent("DeviceConnected", nil)
+	events, err := st.inst.getSTEvents(0)
+	if err != nil || len(events) != 1 || events[0].ID != id {
+		t.Errorf("Expected only ItemStarted, got %#v (%v)", events, err)
+	}
+	if latest, err := st.inst.getLatestEventID(); err != nil || latest != id {
+		t.Errorf("Expected latest event %d, got %d (%v)", id, latest, err)
+	}
+	st.version = "v0.11.0"
+	if _, err := st.inst.getCapabilities(); err == nil {
+		t.Error("Unsupported version not reported")
+	}
+}
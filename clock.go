@@ -0,0 +1,69 @@
+// clock.go
+package main
+
+import "time"
+
+// clock provides the current time to changeAccumulator, such that it can be driven by a virtual clock
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// virtualClock is a clock which only advances when told to
+type virtualClock struct {
+	now time.Time
+}
+
+func (c *virtualClock) Now() time.Time { return c.now }
+
+// advanceTo moves the clock forward to t, it never goes back in time
+func (c *virtualClock) advanceTo(t time.Time) {
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// runAccumulator feeds events into a, advancing clock in the same way accumulateChanges
+// advances its flush timer. Events are processed in order; events without a time happen
+// immediately. When until is zero, it returns once all events are processed and a has
+// nothing left to inform about, otherwise it returns when the next flush is after until.
+func runAccumulator(a *changeAccumulator, clock *virtualClock, events []recordedEvent, until time.Time) {
+	var deadline time.Time
+	for i := 0; ; {
+		if a.flushTimerNeedsReset {
+			a.flushTimerNeedsReset = false
+			deadline = clock.Now().Add(a.flushInterval())
+		}
+		if i < len(events) && !events[i].Time.After(deadline) {
+			ev := events[i]
+			i++
+			clock.advanceTo(ev.Time)
+			switch ev.Kind {
+			case "fs":
+				a.fsEvent(ev.Path)
+				if ev.Writing || ev.Closed {
+					a.fsWrite(ev.Path, ev.Closed)
+				}
+			case "full":
+				a.requestFullScan()
+			case "st":
+				a.stEvent(STEvent{Path: ev.Path, Finished: ev.Finished, Overflow: ev.Overflow, State: ev.State,
+					Restarted: ev.Restarted, Paused: ev.Paused, Resumed: ev.Resumed})
+			}
+			continue
+		}
+		if i == len(events) {
+			if until.IsZero() && len(a.inProgress) == 0 && a.scan == nil && a.currInterval == a.delayScanInterval {
+				return
+			}
+			if !until.IsZero() && deadline.After(until) {
+				return
+			}
+		}
+		clock.advanceTo(deadline)
+		a.flush()
+	}
+}
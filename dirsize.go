@@ -0,0 +1,71 @@
+// dirsize.go
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// subScanCost is the number of paths Syncthing can check while scanning a directory in about the
+// time it takes to scan one more individual path. A directory with more than score*subScanCost
+// paths is more expensive to scan as a whole than its changes one by one.
+const subScanCost = 10
+
+// dirSizeTTL is the time for which the number of paths in a directory is cached
+const dirSizeTTL = 10 * time.Minute
+
+// dirSizeFunc returns the number of paths in dir (relative to the folder), counting at most limit
+type dirSizeFunc func(dir string, limit int) int
+
+type dirCount struct {
+	n        int
+	complete bool // n is the number of all paths, not just limit
+	time     time.Time
+}
+
+// dirSizeCache counts paths in the directories of a folder on the local filesystem. Counting stops
+// at the limit, such that it never costs more than the scan it helps to avoid.
+type dirSizeCache struct {
+	clock      clock
+	folderPath string
+	counts     map[string]dirCount
+}
+
+func newDirSizeCache(clock clock, folderPath string) *dirSizeCache {
+	return &dirSizeCache{clock: clock, folderPath: folderPath, counts: make(map[string]dirCount)}
+}
+
+func (c *dirSizeCache) size(dir string, limit int) int {
+	now := c.clock.Now()
+	if cached, ok := c.counts[dir]; ok && now.Sub(cached.time) < dirSizeTTL && (cached.complete || cached.n >= limit) {
+		if cached.n > limit {
+			return limit
+		}
+		return cached.n
+	}
+	n, complete := countPaths(filepath.Join(c.folderPath, dir), limit)
+	Debug.Printf("[AG] Counted %d paths in %q (complete: %t)", n, dir, complete)
+	if len(c.counts) >= maxFiles {
+		for d, cached := range c.counts {
+			if now.Sub(cached.time) >= dirSizeTTL {
+				delete(c.counts, d)
+			}
+		}
+	}
+	c.counts[dir] = dirCount{n: n, complete: complete, time: now}
+	return n
+}
+
+// countPaths returns the number of files and directories below dir, at most limit, and whether all were counted
+func countPaths(dir string, limit int) (int, bool) {
+	n := 0
+	stopped, _ := walkBelow(dir, func(relPath string, info os.FileInfo) error {
+		if n >= limit {
+			return errStopWalk
+		}
+		n++
+		return nil
+	})
+	return n, !stopped
+}
@@ -0,0 +1,66 @@
+// dirsize_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDirSizeCache(t *testing.T) {
+	createTestPaths(t, "a/file1", "a/file2", "a/b/file3")
+	defer clearTestDir()
+	clock := &virtualClock{now: time.Now()}
+	c := newDirSizeCache(clock, testDirectory)
+	if n := c.size("a", 10); n != 4 {
+		t.Errorf("Expected 4 paths in a, got %d", n)
+	}
+	if n := c.size("a", 2); n != 2 {
+		t.Errorf("Expected counting to stop at 2, got %d", n)
+	}
+	createTestPath(t, "a/file4")
+	if n := c.size("a", 10); n != 4 {
+		t.Errorf("Expected the cached count of 4, got %d", n)
+	}
+	clock.now = clock.now.Add(dirSizeTTL)
+	if n := c.size("a", 10); n != 5 {
+		t.Errorf("Expected 5 paths after the cache expired, got %d", n)
+	}
+	if n := c.size("missing", 10); n != 0 {
+		t.Errorf("Expected no paths in a missing directory, got %d", n)
+	}
+}
+
+func TestAggregateLargeDirectories(t *testing.T) {
+	// A directory is only scanned as a whole if it is not much larger than its changes
+	changedDir := ""
+	pathStat := func(path string) PathStatus {
+		if len(changedDir) > 0 && path == changedDir {
+			return directoryPath
+		}
+		return filePath
+	}
+	sizes := map[string]int{"small": 30, "large": 2000000, "": 2000040}
+	dirSize := func(dir string, limit int) int {
+		if sizes[dir] > limit {
+			return limit
+		}
+		return sizes[dir]
+	}
+	var paths []string
+	for _, dir := range []string{"small", "large"} {
+		for _, f := range []string{"file1", "file2", "file3"} {
+			paths = append(paths, dir+slash+f)
+		}
+	}
+	expected := []string{"large" + slash + "file1", "large" + slash + "file2", "large" + slash + "file3", "small"}
+	if scans := aggregateChanges(slash+"folder", 3, paths, pathStat, dirSize); !slicesEqual(scans, expected) {
+		t.Errorf("Expected %v, got %v", expected, scans)
+	}
+	// Changed directories are always scanned as their contents are unknown
+	changedDir = "large"
+	paths = append(paths, changedDir)
+	expected = []string{"large", "small"}
+	if scans := aggregateChanges(slash+"folder", 3, paths, pathStat, dirSize); !slicesEqual(scans, expected) {
+		t.Errorf("Expected %v, got %v", expected, scans)
+	}
+}
@@ -0,0 +1,169 @@
+// dispatch.go
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// stDispatcher fans out events from watchSTEvents to the accumulators of all folders. Every folder
+// has its own bounded queue, such that a busy folder never blocks the events of other folders.
+type stDispatcher struct {
+	queues map[string]*stQueue
+	done   <-chan struct{}
+}
+
+// stQueue holds the events for a single folder until its accumulator is ready to receive them
+type stQueue struct {
+	folder string // Folder key of the instance (see folderKey)
+	out    chan STEvent
+	wake   chan struct{}
+	done   <-chan struct{}
+
+	mut       sync.Mutex
+	events    []STEvent
+	maxDepth  int // Maximum depth since the last stats report
+	overflows int // Number of times the queue overflowed
+}
+
+// stQueueStats holds metrics about an stQueue
+type stQueueStats struct {
+	Folder    string
+	Depth     int
+	MaxDepth  int
+	Overflows int
+}
+
+// newSTDispatcher starts forwarding events to stChans until done is closed
+func newSTDispatcher(st *stInstance, stChans map[string]chan STEvent, done <-chan struct{}) *stDispatcher {
+	d := &stDispatcher{queues: make(map[string]*stQueue, len(stChans)), done: done}
+	for folder, ch := range stChans {
+		q := &stQueue{folder: st.folderKey(folder), out: ch, wake: make(chan struct{}, 1), done: done}
+		d.queues[folder] = q
+		go q.forward()
+	}
+	return d
+}
+
+// dispatch queues ev for folder without blocking. Returns false if the folder is not watched.
+func (d *stDispatcher) dispatch(folder string, ev STEvent) bool {
+	q, ok := d.queues[folder]
+	if !ok {
+		return false
+	}
+	q.push(ev)
+	return true
+}
+
+// stats returns the metrics of all queues, sorted by folder
+func (d *stDispatcher) stats() []stQueueStats {
+	var stats []stQueueStats
+	for _, q := range d.queues {
+		stats = append(stats, q.stats())
+	}
+	sort.Sort(stQueueStatsByFolder(stats))
+	return stats
+}
+
+// reportStats logs the metrics of queues which were in use every interval until the dispatcher is done
+func (d *stDispatcher) reportStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.done:
+			return
+		}
+		for _, s := range d.stats() {
+			if s.MaxDepth > 0 {
+				Trace.Printf("Event queue of %s: %d queued, at most %d since last report, %d overflows", s.Folder, s.Depth, s.MaxDepth, s.Overflows)
+			}
+		}
+	}
+}
+
+// dispatchAll queues ev for all folders without blocking
+func (d *stDispatcher) dispatchAll(ev STEvent) {
+	for _, q := range d.queues {
+		q.push(ev)
+	}
+}
+
+func (q *stQueue) push(ev STEvent) {
+	q.mut.Lock()
+	if len(q.events) >= stQueueSize {
+		// The accumulator of this folder is too slow. Instead of blocking, drop the queued events
+		// and let the accumulator know that it cannot rely on them. Whether the folder is paused
+		// and whether Syncthing restarted cannot be told from later events, these are kept.
+		var restarted, pausing bool
+		var state STEvent
+		for _, e := range append(q.events, ev) {
+			restarted = restarted || e.Restarted
+			if e.Paused || e.Resumed {
+				pausing, state = true, e
+			}
+		}
+		q.events = append(q.events[:0], STEvent{Overflow: true})
+		if restarted {
+			q.events = append(q.events, STEvent{Restarted: true})
+		}
+		if pausing {
+			q.events = append(q.events, state)
+		}
+		q.overflows++
+		Warning.Println("Too many Syncthing events queued for " + q.folder + ", assuming all changes could be remote")
+	} else {
+		q.events = append(q.events, ev)
+	}
+	if len(q.events) > q.maxDepth {
+		q.maxDepth = len(q.events)
+	}
+	q.mut.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// forward sends queued events to the accumulator until the queue is done
+func (q *stQueue) forward() {
+	for {
+		select {
+		case <-q.wake:
+		case <-q.done:
+			return
+		}
+		for {
+			q.mut.Lock()
+			if len(q.events) == 0 {
+				q.mut.Unlock()
+				break
+			}
+			ev := q.events[0]
+			q.events = q.events[1:]
+			q.mut.Unlock()
+			recorder.recordST(q.folder, ev)
+			select {
+			case q.out <- ev:
+			case <-q.done:
+				return
+			}
+		}
+	}
+}
+
+func (q *stQueue) stats() stQueueStats {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	s := stQueueStats{Folder: q.folder, Depth: len(q.events), MaxDepth: q.maxDepth, Overflows: q.overflows}
+	q.maxDepth = len(q.events)
+	return s
+}
+
+type stQueueStatsByFolder []stQueueStats
+
+func (s stQueueStatsByFolder) Len() int           { return len(s) }
+func (s stQueueStatsByFolder) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s stQueueStatsByFolder) Less(i, j int) bool { return s[i].Folder < s[j].Folder }
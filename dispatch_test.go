@@ -0,0 +1,115 @@
+// dispatch_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDispatcherOverflow(t *testing.T) {
+	defer func(s int) { stQueueSize = s }(stQueueSize)
+	stQueueSize = 3
+	busy := make(chan STEvent)
+	idle := make(chan STEvent)
+	done := make(chan struct{})
+	defer close(done)
+	d := newSTDispatcher(newSTInstance(""), map[string]chan STEvent{"busy": busy, "idle": idle}, done)
+	// The busy folder does not receive, the forwarder blocks on its first event
+	d.dispatch("busy", STEvent{Path: "first"})
+	for d.stats()[0].Depth != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Further events for the busy folder must not block events for other folders
+	for i := 0; i < 5; i++ {
+		d.dispatch("busy", STEvent{Path: "a"})
+	}
+	if d.dispatch("unknown", STEvent{Path: "a"}) {
+		t.Error("Dispatched event for unknown folder")
+	}
+	d.dispatch("idle", STEvent{Path: "b"})
+	select {
+	case ev := <-idle:
+		if ev.Path != "b" {
+			t.Errorf("Unexpected event %#v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event for idle folder blocked by busy folder")
+	}
+	stats := d.stats()
+	if len(stats) != 2 || stats[0].Folder != "busy" || stats[0].MaxDepth != 3 || stats[0].Overflows != 1 || stats[0].Depth != 2 {
+		t.Errorf("Unexpected stats %#v", stats)
+	}
+	// Queued events were replaced by a single overflow event, later events are queued after it
+	expected := []STEvent{{Path: "first"}, {Overflow: true}, {Path: "a"}}
+	for _, exp := range expected {
+		select {
+		case ev := <-busy:
+			if ev != exp {
+				t.Errorf("Expected %#v, got %#v", exp, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %#v, got nothing", exp)
+		}
+	}
+	for d.stats()[0].Depth != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := d.stats(); stats[0].MaxDepth != 0 || stats[1].MaxDepth != 0 {
+		t.Errorf("Maximum depth not reset after report %#v", stats)
+	}
+}
+
+func TestOverflowScansAllChanges(t *testing.T) {
+	// After lost events, changes can no longer be ignored as originating from Syncthing
+	testRepo := "test1"
+	testFiles := createTestPaths(t, "file1", "file2")
+	defer clearTestDir()
+	var informed [][]string
+	fileChange := func(repo string, sub []string) error {
+		if len(sub) == 1 && sub[0] == ".stfolder" {
+			return nil
+		}
+		informed = append(informed, sub)
+		return nil
+	}
+	events := []recordedEvent{
+		stEvent(testFiles[0], false),
+		stEvent(testFiles[1], false),
+		{Kind: "st", Overflow: true},
+		fsEvent(testFiles[0]),
+		fsEvent(testFiles[1]),
+	}
+	accumulate(100*time.Millisecond, testRepo, 10, events, fileChange)
+	if len(informed) != 1 || !slicesEqual(informed[0], testFiles) {
+		t.Errorf("Expected a scan of %v, got %v", testFiles, informed)
+	}
+}
+
+func TestDispatcherOverflowKeepsPauseState(t *testing.T) {
+	defer func(s int) { stQueueSize = s }(stQueueSize)
+	stQueueSize = 3
+	busy := make(chan STEvent)
+	done := make(chan struct{})
+	defer close(done)
+	d := newSTDispatcher(newSTInstance(""), map[string]chan STEvent{"busy": busy}, done)
+	d.dispatch("busy", STEvent{Path: "first"})
+	for d.stats()[0].Depth != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The folder is paused and resumed and paused again while its queue overflows
+	d.dispatch("busy", STEvent{Paused: true})
+	d.dispatch("busy", STEvent{Restarted: true})
+	d.dispatch("busy", STEvent{Resumed: true})
+	d.dispatch("busy", STEvent{Paused: true})
+	expected := []STEvent{{Path: "first"}, {Overflow: true}, {Restarted: true}, {Paused: true}}
+	for _, exp := range expected {
+		select {
+		case ev := <-busy:
+			if ev != exp {
+				t.Errorf("Expected %#v, got %#v", exp, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %#v, got nothing", exp)
+		}
+	}
+}
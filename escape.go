@@ -0,0 +1,72 @@
+// escape.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// escapingWriter escapes control characters and invalid UTF-8 in log lines, such that file names
+// with newlines or terminal escape sequences cannot break or forge lines of the log.
+type escapingWriter struct {
+	w io.Writer
+}
+
+func (e escapingWriter) Write(p []byte) (int, error) {
+	// The log package writes whole lines, only their final newline is kept
+	line := p
+	newline := len(line) > 0 && line[len(line)-1] == '\n'
+	if newline {
+		line = line[:len(line)-1]
+	}
+	escaped := escapeControl(string(line))
+	if newline {
+		escaped += "\n"
+	}
+	if _, err := io.WriteString(e.w, escaped); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// escapeControl replaces control and format characters in s by Go escape sequences and invalid
+// UTF-8 by \x escapes of its bytes. Backslashes are escaped as well, such that a file named a\n
+// cannot be mistaken for an escaped newline, unless they separate paths (Windows).
+func escapeControl(s string) string {
+	clean := true
+	for _, r := range s {
+		if r == utf8.RuneError || !unicode.IsGraphic(r) || isEscapedBackslash(r) {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return s
+	}
+	var out []byte
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size <= 1:
+			out = append(out, fmt.Sprintf(`\x%02x`, s[i])...)
+		case isEscapedBackslash(r):
+			out = append(out, `\\`...)
+		case unicode.IsGraphic(r):
+			out = append(out, s[i:i+size]...)
+		default:
+			quoted := strconv.QuoteRuneToASCII(r)
+			out = append(out, quoted[1:len(quoted)-1]...)
+		}
+		i += size
+	}
+	return string(out)
+}
+
+// isEscapedBackslash reports whether r is a backslash that is not the path separator
+func isEscapedBackslash(r rune) bool {
+	return r == '\\' && os.PathSeparator != '\\'
+}
@@ -0,0 +1,49 @@
+// escape_test.go
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestEscapeControl(t *testing.T) {
+	// Backslashes separate paths on Windows, file names cannot contain them there
+	backslash := `\\`
+	if os.PathSeparator == '\\' {
+		backslash = `\`
+	}
+	cases := []struct {
+		s, expected string
+	}{
+		{"plain/file.txt", "plain/file.txt"},
+		{"with space", "with space"},
+		{"ünïcödé/日本語 😀", "ünïcödé/日本語 😀"},
+		{"new\nline", `new\nline`},
+		{"tab\tand\rreturn", `tab\tand\rreturn`},
+		{"esc\x1b[31mred", `esc\x1b[31mred`},
+		{"invalid\xff\xfeutf8", `invalid\xff\xfeutf8`},
+		{"bidi\u202eoverride", `bidi\u202eoverride`},
+		{"replacement�char", "replacement�char"},
+		{"~", "~"},
+		{`literal\n`, "literal" + backslash + "n"},
+		{"back\\slash\nnewline", "back" + backslash + `slash\nnewline`},
+	}
+	for _, c := range cases {
+		if s := escapeControl(c.s); s != c.expected {
+			t.Errorf("Expected %q to be escaped to %s, got %s", c.s, c.expected, s)
+		}
+	}
+}
+
+func TestEscapingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	l := log.New(escapingWriter{&buf}, "[DEBUG] ", 0)
+	l.Println("Tracking: a\n[WARNING] forged")
+	l.Println("Tracking: b")
+	expected := "[DEBUG] Tracking: a\\n[WARNING] forged\n[DEBUG] Tracking: b\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
@@ -0,0 +1,150 @@
+// explain.go
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const explainUsage = "syncthing-inotify explain [options] < paths.txt"
+
+// explainMain implements the explain subcommand: it reads changed paths (one per line) from stdin,
+// runs them through aggregateChanges and prints every decision as a tree. Returns the exit code.
+func explainMain(args []string) int {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	folderPath := "."
+	explainDirVsFiles := dirVsFiles
+	fs.StringVar(&folderPath, "folder-path", folderPath, "Folder the paths belong to (relative paths are resolved against it)")
+	fs.IntVar(&explainDirVsFiles, "dir-vs-files", explainDirVsFiles, "Number of changes after which a directory is scanned as a whole")
+	fs.Usage = usageFor(fs, explainUsage, explainExtraUsage)
+	fs.Parse(args)
+
+	folderPath, err := filepath.Abs(expandTilde(folderPath))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	paths, err := readExplainPaths(os.Stdin, folderPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	explainChanges(os.Stdout, folderPath, explainDirVsFiles, paths, currentPathStatus, newDirSizeCache(realClock{}, folderPath).size)
+	return 0
+}
+
+const explainExtraUsage = `
+Paths are read from stdin, one per line. Relative paths are resolved against
+-folder-path, absolute paths have to be located inside of it. The status of
+every path (file, directory or deleted) is taken from the local filesystem.
+
+Every changed file adds 1 to the score of its directory and of all tracked
+parent directories. Changed directories and deleted paths start with a score
+of -dir-vs-files and are therefore always scanned, unless a parent directory
+is scanned. A directory with a score of at least -dir-vs-files is scanned as
+a whole instead of its individual changes, unless it contains more than
+10 paths per change (counted on the local filesystem): then scanning its
+changes individually is cheaper.`
+
+// readExplainPaths reads one path per line and makes them absolute within folderPath
+func readExplainPaths(r io.Reader, folderPath string) ([]string, error) {
+	var paths []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		path := strings.TrimRight(s.Text(), "\r")
+		if len(strings.TrimSpace(path)) == 0 {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(folderPath, path)
+		} else if _, ok := trimFolder(path, folderPath); !ok {
+			return nil, fmt.Errorf("%s is not located in %s", path, folderPath)
+		}
+		paths = append(paths, path)
+	}
+	return paths, s.Err()
+}
+
+// explainChanges writes the aggregation decisions for paths as a tree to w
+func explainChanges(w io.Writer, folderPath string, dirVsFiles int, paths []string, pathStatus statPathFunc, dirSize dirSizeFunc) []string {
+	var decisions []aggregationDecision
+	scans := explainAggregation(folderPath, dirVsFiles, paths, pathStatus, dirSize, func(d aggregationDecision) {
+		decisions = append(decisions, d)
+	})
+
+	fmt.Fprintf(w, "Aggregating %d changes in %s (dir-vs-files %d)\n\n", len(paths), folderPath, dirVsFiles)
+	var rows [][]string
+	var parents []string
+	// Parents have to be seen directly before their children, a.txt must not come between a and a/b
+	sort.Sort(decisionsByPath(decisions))
+	for _, d := range decisions {
+		for len(parents) > 0 && !isParentPath(parents[len(parents)-1], d.Path) {
+			parents = parents[:len(parents)-1]
+		}
+		name := d.Path
+		if len(name) == 0 {
+			name = "<folder>"
+		}
+		verdict := "skip"
+		if d.Scan {
+			verdict = "SCAN"
+		}
+		rows = append(rows, []string{strings.Repeat("  ", len(parents)) + name, explainScore(d), verdict, d.Reason})
+		if d.Status != filePath {
+			parents = append(parents, d.Path)
+		}
+	}
+	optionTable(w, rows)
+
+	fmt.Fprintf(w, "\nResulting scan requests (%d):\n", len(scans))
+	for _, scan := range scans {
+		if len(scan) == 0 {
+			scan = "<folder>"
+		}
+		fmt.Fprintln(w, "  "+scan)
+	}
+	return scans
+}
+
+func explainScore(d aggregationDecision) string {
+	switch d.Status {
+	case filePath:
+		return "file"
+	case deletedPath:
+		return fmt.Sprintf("deleted, score %d", d.Score)
+	}
+	return fmt.Sprintf("dir, score %d", d.Score)
+}
+
+// isParentPath reports whether parent is a parent directory of path, relative to the folder root
+func isParentPath(parent string, path string) bool {
+	if len(parent) == 0 {
+		return len(path) > 0
+	}
+	return strings.HasPrefix(path, parent+pathSeparator)
+}
+
+// decisionsByPath sorts decisions by the components of their paths
+type decisionsByPath []aggregationDecision
+
+func (d decisionsByPath) Len() int           { return len(d) }
+func (d decisionsByPath) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d decisionsByPath) Less(i, j int) bool { return lessPath(d[i].Path, d[j].Path) }
+
+// lessPath compares paths component by component, such that a directory is directly followed by its contents
+func lessPath(a string, b string) bool {
+	as := strings.Split(a, pathSeparator)
+	bs := strings.Split(b, pathSeparator)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
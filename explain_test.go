@@ -0,0 +1,75 @@
+// explain_test.go
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExplainChanges(t *testing.T) {
+	pathStat := func(path string) PathStatus {
+		if strings.Contains(path, "deleted") {
+			return deletedPath
+		} else if strings.Contains(path, "file") {
+			return filePath
+		}
+		return directoryPath
+	}
+	folderPath := slash + "path" + slash + "to" + slash + "folder"
+	paths := []string{"a" + slash + "file1", "a" + slash + "file2", "a" + slash + "file3",
+		"b" + slash + "file1", "b" + slash + "deleted1"}
+	for i := range paths {
+		paths[i] = folderPath + slash + paths[i]
+	}
+	var out bytes.Buffer
+	scans := explainChanges(&out, folderPath, 3, paths, pathStat, nil)
+	expected := []string{"a", "b" + slash + "deleted1", "b" + slash + "file1"}
+	if !slicesEqual(scans, expected) {
+		t.Errorf("Expected: %#v, got: %#v", expected, scans)
+	}
+	lines := strings.Split(out.String(), "\n")
+	checkLine := func(prefix string, contains ...string) {
+		for _, line := range lines {
+			if !strings.HasPrefix(line, prefix+" ") {
+				continue
+			}
+			for _, c := range contains {
+				if !strings.Contains(line, c) {
+					t.Errorf("Expected %q in line %q", c, line)
+				}
+			}
+			return
+		}
+		t.Errorf("No line for %q in:\n%s", prefix, out.String())
+	}
+	checkLine("a", "dir, score 3", "SCAN", "score 3 >= 3")
+	checkLine("  a"+slash+"file1", "file", "skip", "covered by scan of a")
+	checkLine("b", "dir, score 1", "skip", "score 1 < 3")
+	checkLine("  b"+slash+"file1", "file", "SCAN", "changed file")
+	checkLine("  b"+slash+"deleted1", "deleted", "SCAN", "deleted path")
+}
+
+func TestExplainChangesSiblingOrder(t *testing.T) {
+	pathStat := func(path string) PathStatus {
+		if strings.HasSuffix(path, slash+"a") {
+			return directoryPath
+		}
+		return filePath
+	}
+	folderPath := slash + "folder"
+	// As strings a.txt sorts between a and a/b
+	paths := []string{folderPath + slash + "a", folderPath + slash + "a.txt", folderPath + slash + "a" + slash + "b"}
+	var out bytes.Buffer
+	explainChanges(&out, folderPath, 10, paths, pathStat, nil)
+	tree := strings.Split(strings.Split(out.String(), "\n\n")[1], "\n")
+	expected := []string{"<folder>", "  a", "    a" + slash + "b", "  a.txt"}
+	if len(tree) != len(expected) {
+		t.Fatalf("Expected %d lines, got:\n%s", len(expected), out.String())
+	}
+	for i, line := range tree {
+		if !strings.HasPrefix(line, expected[i]+" ") {
+			t.Errorf("Expected line %d to start with %q, got %q", i, expected[i], line)
+		}
+	}
+}
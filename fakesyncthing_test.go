@@ -0,0 +1,567 @@
+// fakesyncthing_test.go
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeScan is a scan request received by fakeSyncthing
+type fakeScan struct {
+	Folder string
+	Subs   []string
+	Next   string
+}
+
+// fakeSyncthing is an in-process Syncthing REST API. It records scan and error requests
+// and can be told to fail requests or to restart.
+type fakeSyncthing struct {
+	*httptest.Server
+	apiKey    string
+	csrfToken string
+	version   string
+	inst      *stInstance // Connects to the fake
+
+	mut         sync.Mutex
+	changed     *sync.Cond // signalled whenever events, scans or errors are added
+	folders     []FolderConfiguration
+	events      []Event
+	lastEventID int
+	polledSince int // the since parameter of the latest request for events
+	inSync      bool
+	failures    map[string][]int // URL path => status codes to return for the next requests
+	scans       []fakeScan
+	errors      []string
+}
+
+func newFakeSyncthing(folders ...FolderConfiguration) *fakeSyncthing {
+	f := &fakeSyncthing{
+		apiKey:   "fake-api-key",
+		version:  "v0.14.0",
+		folders:  folders,
+		inSync:   true,
+		failures: make(map[string][]int),
+	}
+	f.changed = sync.NewCond(&f.mut)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/system/config", f.handleConfig)
+	mux.HandleFunc("/rest/config/folders", f.handleConfigFolders)
+	mux.HandleFunc("/rest/system/version", f.handleVersion)
+	mux.HandleFunc("/rest/system/config/insync", f.handleInSync)
+	mux.HandleFunc("/rest/events", f.handleEvents)
+	mux.HandleFunc("/rest/db/scan", f.handleScan)
+	mux.HandleFunc("/rest/system/error", f.handleError)
+	f.Server = httptest.NewServer(f.authenticate(mux))
+	f.inst = newSTInstance("")
+	f.inst.target = f.URL
+	f.inst.apiKey = f.apiKey
+	return f
+}
+
+// runUntilStopped runs fn in a goroutine until the returned function is called, which closes
+// done and waits for fn to return
+func runUntilStopped(fn func(done <-chan struct{})) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		fn(done)
+		close(stopped)
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// use shortens the timeouts for f until the returned function is called, which also stops f
+func (f *fakeSyncthing) use() func() {
+	oldConfigSyncTimeout := configSyncTimeout
+	configSyncTimeout = 10 * time.Millisecond
+	return func() {
+		configSyncTimeout = oldConfigSyncTimeout
+		f.Close()
+	}
+}
+
+func (f *fakeSyncthing) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(f.apiKey) > 0 && r.Header.Get("X-API-Key") == f.apiKey ||
+			len(f.csrfToken) > 0 && r.Header.Get("X-CSRF-Token") == f.csrfToken {
+			if status := f.failure(r.URL.Path); status != 0 {
+				http.Error(w, "injected failure", status)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "CSRF Error", http.StatusForbidden)
+	})
+}
+
+// fail makes the next requests to path return the given status codes
+func (f *fakeSyncthing) fail(path string, statuses ...int) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.failures[path] = append(f.failures[path], statuses...)
+}
+
+func (f *fakeSyncthing) failure(path string) int {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	statuses := f.failures[path]
+	if len(statuses) == 0 {
+		return 0
+	}
+	f.failures[path] = statuses[1:]
+	return statuses[0]
+}
+
+// restart drops all connections and forgets all events, like a restarted Syncthing.
+// The next request for events fails as Syncthing is not reachable while restarting.
+func (f *fakeSyncthing) restart() {
+	f.mut.Lock()
+	f.events = nil
+	f.lastEventID = 0
+	f.failures["/rest/events"] = append(f.failures["/rest/events"], http.StatusServiceUnavailable)
+	f.changed.Broadcast()
+	f.mut.Unlock()
+	f.CloseClientConnections()
+}
+
+func (f *fakeSyncthing) setInSync(inSync bool) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.inSync = inSync
+}
+
+// addEvent appends an event and returns its ID
+func (f *fakeSyncthing) addEvent(eventType string, data map[string]interface{}) int {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.appendEvent(eventType, data)
+}
+
+func (f *fakeSyncthing) appendEvent(eventType string, data map[string]interface{}) int {
+	f.lastEventID++
+	f.events = append(f.events, Event{ID: f.lastEventID, Time: time.Now(), Type: eventType, Data: data})
+	f.changed.Broadcast()
+	return f.lastEventID
+}
+
+// waitFor blocks until cond (evaluated with f locked) is true or the timeout expires
+func (f *fakeSyncthing) waitFor(timeout time.Duration, cond func() bool) bool {
+	timer := time.AfterFunc(timeout, func() {
+		f.mut.Lock()
+		f.changed.Broadcast()
+		f.mut.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		f.changed.Wait()
+	}
+	return true
+}
+
+// waitForEventsPolled blocks until a client asked for events after id, i.e. it received all events up to id
+func (f *fakeSyncthing) waitForEventsPolled(t *testing.T, id int) {
+	if !f.waitFor(5*time.Second, func() bool { return f.polledSince >= id }) {
+		t.Fatalf("Events up to %d were not polled", id)
+	}
+}
+
+// scanRequests returns all scan requests received so far
+func (f *fakeSyncthing) scanRequests() []fakeScan {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return append([]fakeScan(nil), f.scans...)
+}
+
+// scansFor returns the scan requests for folder, ignoring requests to delay the full scan
+func (f *fakeSyncthing) scansFor(folder string) []fakeScan {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.folderScans(folder)
+}
+
+// folderScans is scansFor with f locked, e.g. in a condition of waitFor
+func (f *fakeSyncthing) folderScans(folder string) []fakeScan {
+	var scans []fakeScan
+	for _, scan := range f.scans {
+		if scan.Folder == folder && !(len(scan.Subs) == 1 && scan.Subs[0] == ".stfolder") {
+			scans = append(scans, scan)
+		}
+	}
+	return scans
+}
+
+func (f *fakeSyncthing) handleConfig(w http.ResponseWriter, r *http.Request) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	json.NewEncoder(w).Encode(Configuration{Version: 12, Folders: f.folders})
+}
+
+func (f *fakeSyncthing) handleConfigFolders(w http.ResponseWriter, r *http.Request) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	json.NewEncoder(w).Encode(f.folders)
+}
+
+func (f *fakeSyncthing) handleVersion(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{"version": f.version, "os": "linux", "arch": "amd64"})
+}
+
+func (f *fakeSyncthing) handleInSync(w http.ResponseWriter, r *http.Request) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	json.NewEncoder(w).Encode(map[string]bool{"configInSync": f.inSync})
+}
+
+func (f *fakeSyncthing) handleEvents(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+	var types map[string]bool
+	if filter := r.URL.Query().Get("events"); len(filter) > 0 {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(filter, ",") {
+			types[t] = true
+		}
+	}
+	var events []Event
+	f.waitFor(200*time.Millisecond, func() bool {
+		if since > f.polledSince {
+			f.polledSince = since
+			f.changed.Broadcast()
+		}
+		events = nil
+		for _, ev := range f.events {
+			if ev.ID > since && (types == nil || types[ev.Type]) {
+				events = append(events, ev)
+			}
+		}
+		return len(events) > 0
+	})
+	if limit, _ := strconv.Atoi(r.URL.Query().Get("limit")); limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	// Like Syncthing, respond with null when there are no new events
+	json.NewEncoder(w).Encode(events)
+}
+
+func (f *fakeSyncthing) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	known := false
+	for _, folder := range f.folders {
+		known = known || folder.ID == query.Get("folder")
+	}
+	if !known {
+		http.Error(w, "Folder "+query.Get("folder")+" does not exist", http.StatusInternalServerError)
+		return
+	}
+	f.scans = append(f.scans, fakeScan{Folder: query.Get("folder"), Subs: query["sub"], Next: query.Get("next")})
+	f.appendEvent("StateChanged", map[string]interface{}{"folder": query.Get("folder"), "from": "idle", "to": "scanning"})
+	f.appendEvent("StateChanged", map[string]interface{}{"folder": query.Get("folder"), "from": "scanning", "to": "idle"})
+}
+
+func (f *fakeSyncthing) handleError(w http.ResponseWriter, r *http.Request) {
+	bs, _ := ioutil.ReadAll(r.Body)
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.errors = append(f.errors, string(bs))
+	f.changed.Broadcast()
+}
+
+func TestTestWebGuiPost(t *testing.T) {
+	st := newFakeSyncthing()
+	defer st.use()()
+	if err := st.inst.testWebGuiPost(); err != nil {
+		t.Error("Failed to connect to Syncthing", err)
+	}
+	st.inst.apiKey = "wrong"
+	if err := st.inst.testWebGuiPost(); err == nil {
+		t.Error("Connected to Syncthing with an invalid API key")
+	}
+	st.inst.apiKey = ""
+	st.inst.csrfToken = "csrf"
+	st.csrfToken = "csrf"
+	if err := st.inst.testWebGuiPost(); err != nil {
+		t.Error("Failed to connect to Syncthing using a CSRF token", err)
+	}
+}
+
+func TestGetFolders(t *testing.T) {
+	st := newFakeSyncthing(FolderConfiguration{ID: "id1", Label: "Label", Path: "/a", RescanIntervalS: 60},
+		FolderConfiguration{ID: "id2", Path: "/b"})
+	defer st.use()()
+	folders, err := st.inst.getFolders()
+	if err != nil || len(folders) != 2 || folders[0].Label != "Label" || folders[0].Path != "/a" || folders[0].RescanIntervalS != 60 {
+		t.Errorf("Invalid folders: %#v (%v)", folders, err)
+	}
+	if len(folders) == 2 && folders[1].Label != "id2" {
+		t.Errorf("Folder ID not used as empty label: %#v", folders[1])
+	}
+	st.fail("/rest/system/config", http.StatusInternalServerError)
+	if _, err := st.inst.getFolders(); err == nil {
+		t.Error("Injected failure not reported")
+	}
+}
+
+func TestWaitForFolderChange(t *testing.T) {
+	folder := FolderConfiguration{ID: "id1", Label: "id1", Path: "/a"}
+	st := newFakeSyncthing(folder)
+	defer st.use()()
+	stChan := make(chan STEvent, 10)
+	configSaved := make(chan struct{}, 1)
+	defer runUntilStopped(func(done <-chan struct{}) {
+		st.inst.watchSTEvents(map[string]chan STEvent{"id1": stChan}, configSaved, done)
+	})()
+	changed := make(chan []FolderConfiguration)
+	go func() {
+		changed <- st.inst.waitForFolderChange([]FolderConfiguration{folder}, configSaved)
+	}()
+	// Saving the configuration without changing folders does not require watching them again
+	id := st.addEvent("ConfigSaved", nil)
+	st.waitForEventsPolled(t, id)
+	select {
+	case folders := <-changed:
+		t.Fatalf("Folders reported as changed: %#v", folders)
+	case <-time.After(100 * time.Millisecond):
+	}
+	st.mut.Lock()
+	st.folders = append(st.folders, FolderConfiguration{ID: "id2", Path: "/b"})
+	st.mut.Unlock()
+	st.addEvent("ConfigSaved", nil)
+	select {
+	case folders := <-changed:
+		if len(folders) != 2 || folders[1].ID != "id2" {
+			t.Errorf("Invalid changed folders: %#v", folders)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Changed folders not reported")
+	}
+}
+
+func TestInformChange(t *testing.T) {
+	st := newFakeSyncthing(FolderConfiguration{ID: "id1", Path: "/a"})
+	defer st.use()()
+	if err := st.inst.informChange("id1", []string{"a", "b/c"}); err != nil {
+		t.Error("Failed to inform change", err)
+	}
+	st.fail("/rest/db/scan", http.StatusInternalServerError)
+	if err := st.inst.informChange("id1", []string{"d"}); err == nil {
+		t.Error("Injected failure not reported")
+	}
+	if err := st.inst.informChange("unknown", []string{"d"}); err == nil {
+		t.Error("Scan of unknown folder not reported")
+	}
+	if scans := st.scanRequests(); len(scans) != 1 || scans[0].Folder != "id1" || !slicesEqual(scans[0].Subs, []string{"a", "b/c"}) ||
+		scans[0].Next != strconv.Itoa(delayScan) {
+		t.Errorf("Invalid scans: %#v", scans)
+	}
+}
+
+func TestInformError(t *testing.T) {
+	st := newFakeSyncthing()
+	defer st.use()()
+	if err := st.inst.informError("Something failed"); err != nil {
+		t.Error("Failed to inform error", err)
+	}
+	if len(st.errors) != 1 || st.errors[0] != "[Inotify] Something failed" {
+		t.Errorf("Invalid errors: %#v", st.errors)
+	}
+}
+
+func TestGetSTEvents(t *testing.T) {
+	st := newFakeSyncthing()
+	defer st.use()()
+	st.addEvent("ItemStarted", map[string]interface{}{"folder": "id1", "item": "a"})
+	id := st.addEvent("ItemFinished", map[string]interface{}{"folder": "id1", "item": "a"})
+	events, err := st.inst.getSTEvents(0)
+	if err != nil || len(events) != 2 || events[1].ID != id || events[1].Type != "ItemFinished" {
+		t.Errorf("Invalid events: %#v %v", events, err)
+	}
+	events, err = st.inst.getSTEvents(id)
+	if err != nil || events != nil {
+		t.Errorf("Expected no events: %#v %v", events, err)
+	}
+	st.fail("/rest/events", http.StatusInternalServerError)
+	if _, err := st.inst.getSTEvents(0); err == nil {
+		t.Error("Injected failure not reported")
+	}
+}
+
+func TestWaitForSync(t *testing.T) {
+	st := newFakeSyncthing()
+	defer st.use()()
+	st.setInSync(false)
+	st.fail("/rest/system/config/insync", http.StatusInternalServerError)
+	done := make(chan bool)
+	go func() {
+		st.inst.waitForSync()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Returned before Syncthing was in sync")
+	case <-time.After(100 * time.Millisecond):
+	}
+	st.setInSync(true)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Did not return after Syncthing was in sync")
+	}
+}
+
+func TestWatchSTEventsRestart(t *testing.T) {
+	st := newFakeSyncthing()
+	defer st.use()()
+	stChan := make(chan STEvent, 10)
+	defer runUntilStopped(func(done <-chan struct{}) {
+		st.inst.watchSTEvents(map[string]chan STEvent{"id1": stChan}, nil, done)
+	})()
+	st.waitForEventsPolled(t, 0)
+	st.addEvent("ItemStarted", map[string]interface{}{"folder": "id1", "item": "a"})
+	st.addEvent("ItemStarted", map[string]interface{}{"folder": "other", "item": "b"})
+	id := st.addEvent("RemoteIndexUpdated", map[string]interface{}{"folder": "id1"})
+	st.waitForEventsPolled(t, id)
+	st.restart()
+	// Event IDs start from 1 again after a restart
+	st.addEvent("ItemFinished", map[string]interface{}{"folder": "id1", "item": "a"})
+	// Folders learn about the restart, as the end of scans was lost
+	expected := []STEvent{{Path: "a"}, {Path: ""}, {Restarted: true}, {Path: "a", Finished: true}}
+	for _, exp := range expected {
+		select {
+		case ev := <-stChan:
+			if ev != exp {
+				t.Errorf("Expected %#v, got %#v", exp, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %#v, got nothing", exp)
+		}
+	}
+}
+
+func TestWatchSTEventsPause(t *testing.T) {
+	st := newFakeSyncthing()
+	defer st.use()()
+	stChan := make(chan STEvent, 10)
+	defer runUntilStopped(func(done <-chan struct{}) {
+		st.inst.watchSTEvents(map[string]chan STEvent{"id1": stChan}, nil, done)
+	})()
+	st.addEvent("FolderPaused", map[string]interface{}{"id": "id1", "label": "Label"})
+	st.addEvent("FolderPaused", map[string]interface{}{"id": "other", "label": "Other"})
+	st.addEvent("FolderResumed", map[string]interface{}{"id": "id1", "label": "Label"})
+	expected := []STEvent{{Paused: true}, {Resumed: true}}
+	for _, exp := range expected {
+		select {
+		case ev := <-stChan:
+			if ev != exp {
+				t.Errorf("Expected %#v, got %#v", exp, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %#v, got nothing", exp)
+		}
+	}
+}
+
+func TestWatchFolderEndToEnd(t *testing.T) {
+	defer func(d time.Duration) { debounceTimeout = d }(debounceTimeout)
+	debounceTimeout = 50 * time.Millisecond
+	dir, err := ioutil.TempDir("", "syncthing-inotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	folder := FolderConfiguration{ID: "e2e", Label: "End to end", Path: dir}
+	st := newFakeSyncthing(folder)
+	defer st.use()()
+	stChan := make(chan STEvent)
+	defer runUntilStopped(func(done <-chan struct{}) {
+		st.inst.watchSTEvents(map[string]chan STEvent{folder.ID: stChan}, nil, done)
+	})()
+	defer runUntilStopped(func(done <-chan struct{}) {
+		st.inst.watchFolder(folder, stChan, done)
+	})()
+	// Syncthing is asked to delay its full scan as soon as the folder is watched
+	if !st.waitFor(5*time.Second, func() bool { return len(st.scans) > 0 }) {
+		t.Fatal("No request to delay the full scan")
+	}
+	if s := st.scanRequests()[0]; s.Folder != folder.ID || !slicesEqual(s.Subs, []string{".stfolder"}) || s.Next != strconv.Itoa(delayScan) {
+		t.Errorf("Invalid request to delay the full scan: %#v", s)
+	}
+
+	// Local changes are scanned, a failed scan is retried
+	st.fail("/rest/db/scan", http.StatusInternalServerError)
+	if err := ioutil.WriteFile(filepath.Join(dir, "local"), []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !st.waitFor(5*time.Second, func() bool { return len(st.folderScans(folder.ID)) > 0 }) {
+		t.Fatal("Local change not scanned")
+	}
+	if scans := st.scansFor(folder.ID); !slicesEqual(scans[0].Subs, []string{"local"}) {
+		t.Errorf("Invalid scan for local change: %#v", scans)
+	}
+
+	// Changes made by Syncthing itself are not scanned. Syncthing renames temporary files into place.
+	tmp, err := ioutil.TempDir("", "syncthing-inotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "pulled"), []byte("pulled"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id := st.addEvent("ItemStarted", map[string]interface{}{"folder": folder.ID, "item": "pulled"})
+	st.waitForEventsPolled(t, id)
+	if err := os.Rename(filepath.Join(tmp, "pulled"), filepath.Join(dir, "pulled")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	st.addEvent("ItemFinished", map[string]interface{}{"folder": folder.ID, "item": "pulled"})
+	if err := ioutil.WriteFile(filepath.Join(dir, "local2"), []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !st.waitFor(5*time.Second, func() bool { return len(st.folderScans(folder.ID)) > 1 }) {
+		t.Fatal("Second local change not scanned")
+	}
+	for _, scan := range st.scansFor(folder.ID)[1:] {
+		for _, sub := range scan.Subs {
+			if sub == "pulled" {
+				t.Errorf("Change made by Syncthing was scanned: %#v", scan)
+			}
+		}
+	}
+}
+
+func TestInformChangeSpecialNames(t *testing.T) {
+	// Subs reach Syncthing byte-identical
+	st := newFakeSyncthing(FolderConfiguration{ID: "id1", Path: "/a"})
+	defer st.use()()
+	subs := []string{"new\nline", "invalid\xff\xfe", "~", "~/a", "~b", "a&sub=b", "a+b c", "100%", "a?b#c", "日本語/😀", ""}
+	if err := st.inst.informChange("id1", subs); err != nil {
+		t.Error("Failed to inform change", err)
+	}
+	if scans := st.scanRequests(); len(scans) != 1 || !slicesEqual(scans[0].Subs, subs) {
+		t.Errorf("Expected scan of %q, got %#v", subs, scans)
+	}
+}
@@ -0,0 +1,206 @@
+// instance.go
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// stInstance is a Syncthing instance whose folders are watched. Every instance has its
+// own connection settings, folders and event poller; all instances share one inotify instance.
+type stInstance struct {
+	name         string // Empty unless several instances are watched (-instances)
+	target       string
+	authUser     string
+	authPass     string
+	csrfToken    string
+	apiKey       string
+	watchFolders folderSlice
+	skipFolders  folderSlice
+	stateDir     string // Empty if state is not kept
+	capabilities stCapabilities
+	client       *http.Client
+}
+
+// stInstanceConfig is an entry of the file passed to -instances
+type stInstanceConfig struct {
+	Name        string   `json:"name"`
+	Home        string   `json:"home"`   // Syncthing home to read the settings below from
+	Target      string   `json:"target"` // Overrides the target found in home
+	APIKey      string   `json:"apiKey"` // Overrides the API key found in home
+	User        string   `json:"user"`
+	Password    string   `json:"password"`
+	CsrfFile    string   `json:"csrf"`
+	Folders     []string `json:"folders"`
+	SkipFolders []string `json:"skipFolders"`
+}
+
+func newSTInstance(name string) *stInstance {
+	tr := &http.Transport{
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		ResponseHeaderTimeout: requestTimeout,
+		DisableKeepAlives:     true,
+	}
+	return &stInstance{
+		name: name,
+		client: &http.Client{
+			Transport: tr,
+			Timeout:   requestTimeout,
+		},
+	}
+}
+
+// readInstances reads the Syncthing instances to watch from a JSON file
+func readInstances(path string) ([]*stInstance, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []stInstanceConfig
+	if err := json.Unmarshal(bs, &configs); err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("no instances in " + path)
+	}
+	var instances []*stInstance
+	names := make(map[string]bool)
+	for _, c := range configs {
+		if len(c.Name) == 0 || names[c.Name] {
+			return nil, errors.New("every instance in " + path + " needs a unique name")
+		}
+		names[c.Name] = true
+		st := newSTInstance(c.Name)
+		if len(c.Home) > 0 {
+			if err := st.loadHome(expandTilde(c.Home)); err != nil {
+				return nil, errors.New(c.Name + ": " + err.Error())
+			}
+		}
+		if len(c.Target) > 0 {
+			st.target = c.Target
+		}
+		if len(c.APIKey) > 0 {
+			st.apiKey = c.APIKey
+		}
+		st.authUser = c.User
+		st.authPass = c.Password
+		if len(c.CsrfFile) > 0 {
+			if err := st.loadCsrfFile(expandTilde(c.CsrfFile)); err != nil {
+				return nil, errors.New(c.Name + ": " + err.Error())
+			}
+		}
+		if len(st.target) == 0 {
+			return nil, errors.New(c.Name + ": either home or target is required")
+		}
+		if !strings.Contains(st.target, "://") {
+			st.target = "http://" + st.target
+		}
+		for _, pattern := range append(c.Folders, c.SkipFolders...) {
+			if _, err := matchFolder(pattern, FolderConfiguration{}); err != nil {
+				return nil, errors.New(c.Name + ": " + err.Error())
+			}
+		}
+		st.watchFolders = c.Folders
+		st.skipFolders = c.SkipFolders
+		if len(stateDir) > 0 {
+			st.stateDir = filepath.Join(stateDir, url.QueryEscape(c.Name))
+			if err := os.MkdirAll(st.stateDir, 0700); err != nil {
+				return nil, err
+			}
+		}
+		instances = append(instances, st)
+	}
+	return instances, nil
+}
+
+// loadHome reads the target and API key from the config of Syncthing in home
+func (st *stInstance) loadHome(home string) error {
+	c, err := getSTConfig(home)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(c.Target, "://") {
+		if c.TLS {
+			st.target = "https://" + c.Target
+		} else {
+			st.target = "http://" + c.Target
+		}
+		st.target = strings.Replace(st.target, "0.0.0.0", "127.0.0.1", 1)
+		st.apiKey = c.APIKey
+	}
+	return nil
+}
+
+// loadCsrfFile reads the CSRF token from the last line of path
+func (st *stInstance) loadCsrfFile(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		st.csrfToken = s.Text()
+	}
+	return s.Err()
+}
+
+// String returns the name of the instance for logs
+func (st *stInstance) String() string {
+	if len(st.name) == 0 {
+		return "Syncthing"
+	}
+	return "Syncthing " + st.name
+}
+
+// folderKey identifies folder across instances, e.g. in recordings
+func (st *stInstance) folderKey(folder string) string {
+	if len(st.name) == 0 {
+		return folder
+	}
+	return st.name + "/" + folder
+}
+
+// watchedFolders holds the ignore patterns of all watched folders, by folder path. The inotify
+// instance is shared by all folders and asks it whether a directory should be watched.
+var watchedFolders = struct {
+	sync.Mutex
+	ignores map[string]func(absolutePath string) bool
+}{ignores: make(map[string]func(string) bool)}
+
+func registerIgnores(folderPath string, ignoreTest func(absolutePath string) bool) {
+	watchedFolders.Lock()
+	defer watchedFolders.Unlock()
+	watchedFolders.ignores[folderPath] = ignoreTest
+}
+
+func unregisterIgnores(folderPath string) {
+	watchedFolders.Lock()
+	defer watchedFolders.Unlock()
+	delete(watchedFolders.ignores, folderPath)
+}
+
+// doNotWatch reports whether absolutePath is ignored by the innermost watched folder containing it
+func doNotWatch(absolutePath string) bool {
+	watchedFolders.Lock()
+	defer watchedFolders.Unlock()
+	var folderPath string
+	for p := range watchedFolders.ignores {
+		if (absolutePath == p || strings.HasPrefix(absolutePath, p+pathSeparator)) && len(p) > len(folderPath) {
+			folderPath = p
+		}
+	}
+	if len(folderPath) == 0 {
+		return false
+	}
+	return watchedFolders.ignores[folderPath](absolutePath)
+}
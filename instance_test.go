@@ -0,0 +1,90 @@
+// instance_test.go
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadInstances(t *testing.T) {
+	dir, cleanup := testStateDir(t)
+	defer cleanup()
+	home := filepath.Join(dir, "alice")
+	os.MkdirAll(home, 0700)
+	config := `<configuration><gui tls="true"><address>0.0.0.0:8385</address><apikey>alice-key</apikey></gui></configuration>`
+	if err := ioutil.WriteFile(filepath.Join(home, "config.xml"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(d string) {
+		stateDir = d
+	}(stateDir)
+	stateDir = filepath.Join(dir, "state")
+
+	path := filepath.Join(dir, "instances.json")
+	write := func(json string) {
+		if err := ioutil.WriteFile(path, []byte(json), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`[{"name": "alice", "home": "` + home + `", "folders": ["photos"]},
+		{"name": "bob", "target": "127.0.0.1:8386", "apiKey": "bob-key", "skipFolders": ["tmp"]}]`)
+	instances, err := readInstances(path)
+	if err != nil || len(instances) != 2 {
+		t.Fatalf("Expected two instances, got %v (%v)", instances, err)
+	}
+	alice, bob := instances[0], instances[1]
+	if alice.target != "https://127.0.0.1:8385" || alice.apiKey != "alice-key" || !slicesEqual(alice.watchFolders, []string{"photos"}) {
+		t.Errorf("Invalid instance from home: %+v", alice)
+	}
+	if bob.target != "http://127.0.0.1:8386" || bob.apiKey != "bob-key" || !slicesEqual(bob.skipFolders, []string{"tmp"}) {
+		t.Errorf("Invalid instance from target: %+v", bob)
+	}
+	if alice.stateDir == bob.stateDir || filepath.Dir(alice.stateDir) != stateDir {
+		t.Errorf("Instances share state: %s, %s", alice.stateDir, bob.stateDir)
+	}
+	if alice.folderKey("default") == bob.folderKey("default") {
+		t.Error("Folders of different instances are not told apart")
+	}
+
+	invalid := []string{
+		`[]`,
+		`[{"name": "alice", "target": "a"}, {"name": "alice", "target": "b"}]`,
+		`[{"target": "a"}]`,
+		`[{"name": "alice"}]`,
+		`[{"name": "alice", "target": "a", "folders": ["re:("]}]`,
+	}
+	for _, json := range invalid {
+		write(json)
+		if _, err := readInstances(path); err == nil {
+			t.Errorf("Invalid instances accepted: %s", json)
+		}
+	}
+}
+
+func TestDoNotWatch(t *testing.T) {
+	// Folders of all instances share one inotify instance, paths are matched against the innermost folder
+	a := filepath.Join(slash+"tmp", "a")
+	nested := filepath.Join(a, "nested")
+	registerIgnores(a, func(path string) bool {
+		return filepath.Base(path) == "ignored-in-a"
+	})
+	defer unregisterIgnores(a)
+	registerIgnores(nested, func(path string) bool {
+		return filepath.Base(path) == "ignored-in-nested"
+	})
+	defer unregisterIgnores(nested)
+	cases := map[string]bool{
+		filepath.Join(a, "ignored-in-a"):           true,
+		filepath.Join(a, "ignored-in-nested"):      false,
+		filepath.Join(nested, "ignored-in-nested"): true,
+		filepath.Join(nested, "ignored-in-a"):      false,
+		filepath.Join(a+"b", "ignored-in-a"):       false,
+	}
+	for path, expected := range cases {
+		if doNotWatch(path) != expected {
+			t.Errorf("Expected %t for %s", expected, path)
+		}
+	}
+}
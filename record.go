@@ -0,0 +1,304 @@
+// record.go
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const replayUsage = "syncthing-inotify replay [options] recording"
+
+// recordedEvent is a single line of an event recording (see -record)
+type recordedEvent struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"` // "folder", "fs", "st" or "full"
+	Folder    string    `json:"folder"`
+	Path      string    `json:"path,omitempty"`
+	Finished  bool      `json:"finished,omitempty"`  // st: ItemFinished
+	Overflow  bool      `json:"overflow,omitempty"`  // st: events were dropped
+	Restarted bool      `json:"restarted,omitempty"` // st: Syncthing restarted
+	State     string    `json:"state,omitempty"`     // st: new state of the folder
+	Paused    bool      `json:"paused,omitempty"`    // st: the folder was paused
+	Resumed   bool      `json:"resumed,omitempty"`   // st: the folder was resumed
+	Status    string    `json:"status,omitempty"`    // fs: "file", "dir" or "deleted" at the time of the event
+	Writing   bool      `json:"writing,omitempty"`   // fs: the path was written to
+	Closed    bool      `json:"closed,omitempty"`    // fs: a writer closed the path
+	// Settings of the watcher, only present for kind "folder"
+	FolderPath      string   `json:"folderPath,omitempty"`
+	Interval        string   `json:"interval,omitempty"`
+	MaxInterval     string   `json:"maxInterval,omitempty"`
+	MaxWait         string   `json:"maxWait,omitempty"`
+	HotPaths        []string `json:"hotPaths,omitempty"`
+	HotInterval     string   `json:"hotInterval,omitempty"`
+	WriteTimeout    string   `json:"writeTimeout,omitempty"`
+	DirVsFiles      int      `json:"dirVsFiles,omitempty"`
+	MaxFiles        int      `json:"maxFiles,omitempty"`
+	DelayScan       int      `json:"delayScan,omitempty"`
+	MaxURLLength    int      `json:"maxURLLength,omitempty"`
+	Normalize       bool     `json:"normalize,omitempty"`       // Syncthing events are in NFC
+	CaseInsensitive bool     `json:"caseInsensitive,omitempty"` // Syncthing events match paths in any case
+}
+
+// eventRecorder writes recordedEvents as JSON lines. A nil recorder records nothing.
+type eventRecorder struct {
+	mut sync.Mutex
+	fd  *os.File
+	enc *json.Encoder
+}
+
+// recorder is set when events should be recorded (-record)
+var recorder *eventRecorder
+
+func newEventRecorder(path string) (*eventRecorder, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &eventRecorder{fd: fd, enc: json.NewEncoder(fd)}, nil
+}
+
+func (r *eventRecorder) record(ev recordedEvent) {
+	if r == nil {
+		return
+	}
+	ev.Time = time.Now()
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if err := r.enc.Encode(ev); err != nil {
+		Warning.Println("Failed to record event", err)
+	}
+}
+
+// recordFolder records the settings used to watch folder
+func (r *eventRecorder) recordFolder(folder string, folderPath string, interval time.Duration, normalize bool, caseInsensitive bool) {
+	ev := recordedEvent{Kind: "folder", Folder: folder, FolderPath: folderPath,
+		Interval: interval.String(), DirVsFiles: dirVsFiles, MaxFiles: maxFiles, DelayScan: delayScan,
+		MaxURLLength: maxScanURLLength, Normalize: normalize, CaseInsensitive: caseInsensitive}
+	if maxDebounceTimeout > 0 {
+		ev.MaxInterval = maxDebounceTimeout.String()
+	}
+	if maxWait > 0 {
+		ev.MaxWait = maxWait.String()
+	}
+	if len(hotPaths) > 0 {
+		ev.HotPaths, ev.HotInterval = hotPaths, hotInterval.String()
+	}
+	if writeTimeout > 0 {
+		ev.WriteTimeout = writeTimeout.String()
+	}
+	r.record(ev)
+}
+
+// recordFS records a change within folder
+func (r *eventRecorder) recordFS(folder string, folderPath string, ev FSEvent) {
+	if r == nil {
+		return
+	}
+	var status string
+	switch currentPathStatus(filepath.Join(folderPath, ev.Path)) {
+	case deletedPath:
+		status = "deleted"
+	case directoryPath:
+		status = "dir"
+	default:
+		status = "file"
+	}
+	r.record(recordedEvent{Kind: "fs", Folder: folder, Path: ev.Path, Status: status, Writing: ev.Writing, Closed: ev.Closed})
+}
+
+// recordFullScan records that a full scan of folder was requested to catch up with changes
+func (r *eventRecorder) recordFullScan(folder string) {
+	r.record(recordedEvent{Kind: "full", Folder: folder})
+}
+
+// recordST records an event sent by Syncthing for folder
+func (r *eventRecorder) recordST(folder string, ev STEvent) {
+	r.record(recordedEvent{Kind: "st", Folder: folder, Path: ev.Path, Finished: ev.Finished, Overflow: ev.Overflow, State: ev.State,
+		Restarted: ev.Restarted, Paused: ev.Paused, Resumed: ev.Resumed})
+}
+
+// replayFolder replays the events of a single folder of a recording and writes every InformCallback call to w
+func replayFolder(w io.Writer, settings recordedEvent, events []recordedEvent) {
+	debounce, err := time.ParseDuration(settings.Interval)
+	if err != nil {
+		debounce = debounceTimeout
+	}
+	// Paths are aggregated using their status at the time they were recorded
+	statuses := make(map[string]PathStatus)
+	for _, ev := range events {
+		if ev.Kind != "fs" {
+			continue
+		}
+		switch ev.Status {
+		case "dir":
+			statuses[ev.Path] = directoryPath
+		case "file":
+			statuses[ev.Path] = filePath
+		}
+	}
+	clock := &virtualClock{now: settings.Time}
+	callback := func(folder string, subs []string) error {
+		fmt.Fprintf(w, "%10s %s %q\n", "+"+clock.Now().Sub(settings.Time).String(), folder, subs)
+		return nil
+	}
+	a := newChangeAccumulator(clock, debounce, settings.Folder, settings.FolderPath, settings.DirVsFiles, callback)
+	// Sizes of directories were not recorded
+	a.dirSize = nil
+	a.pathKey = pathKeyFor(settings.Normalize, settings.CaseInsensitive)
+	a.pathStatus = func(path string) PathStatus {
+		if status, ok := statuses[path]; ok {
+			return status
+		}
+		return deletedPath
+	}
+	runAccumulator(a, clock, events, time.Time{})
+}
+
+// readRecording parses a recording into folder settings and per-folder events
+func readRecording(r io.Reader) (map[string]recordedEvent, map[string][]recordedEvent, error) {
+	settings := make(map[string]recordedEvent)
+	events := make(map[string][]recordedEvent)
+	dec := json.NewDecoder(r)
+	for {
+		var ev recordedEvent
+		if err := dec.Decode(&ev); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if ev.Kind == "folder" {
+			settings[ev.Folder] = ev
+			continue
+		}
+		if _, ok := settings[ev.Folder]; !ok {
+			return nil, nil, fmt.Errorf("event for folder %s without its settings", ev.Folder)
+		}
+		events[ev.Folder] = append(events[ev.Folder], ev)
+	}
+	return settings, events, nil
+}
+
+// replayRecording replays all folders (or only the given folder) of a recording
+func replayRecording(r io.Reader, folder string, out io.Writer, override func(*recordedEvent)) error {
+	settings, events, err := readRecording(r)
+	if err != nil {
+		return err
+	}
+	// The accumulator reads these globals, restore them for the caller
+	defer func(m int, d int, u int, i time.Duration, w time.Duration, h []string, hi time.Duration, wt time.Duration) {
+		maxFiles = m
+		delayScan = d
+		maxScanURLLength = u
+		maxDebounceTimeout = i
+		maxWait = w
+		hotPaths, hotInterval = h, hi
+		writeTimeout = wt
+	}(maxFiles, delayScan, maxScanURLLength, maxDebounceTimeout, maxWait, hotPaths, hotInterval, writeTimeout)
+	var folders []string
+	for f := range settings {
+		if len(folder) == 0 || f == folder {
+			folders = append(folders, f)
+		}
+	}
+	if len(folders) == 0 {
+		return fmt.Errorf("folder %s not found in recording", folder)
+	}
+	sort.Strings(folders)
+	for _, f := range folders {
+		s := settings[f]
+		if override != nil {
+			override(&s)
+		}
+		if s.MaxFiles > 0 {
+			maxFiles = s.MaxFiles
+		}
+		delayScan = s.DelayScan
+		if s.MaxURLLength > 0 {
+			maxScanURLLength = s.MaxURLLength
+		}
+		// Durations which were not recorded were not used
+		durations := []struct {
+			value *time.Duration
+			s     string
+		}{{&maxDebounceTimeout, s.MaxInterval}, {&maxWait, s.MaxWait}, {&hotInterval, s.HotInterval},
+			{&writeTimeout, s.WriteTimeout}}
+		for _, d := range durations {
+			*d.value = 0
+			if len(d.s) > 0 {
+				if *d.value, err = time.ParseDuration(d.s); err != nil {
+					return fmt.Errorf("invalid settings of folder %s: %v", f, err)
+				}
+			}
+		}
+		hotPaths = s.HotPaths
+		interval := s.Interval
+		if maxDebounceTimeout > 0 {
+			interval += ", max-interval " + maxDebounceTimeout.String()
+		}
+		fmt.Fprintf(out, "Replaying %d events of %s (interval %s, dir-vs-files %d, max-files %d, delay-scan %d)\n",
+			len(events[f]), f, interval, s.DirVsFiles, maxFiles, delayScan)
+		replayFolder(out, s, events[f])
+	}
+	return nil
+}
+
+// replayMain implements the replay subcommand. Returns the exit code.
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var folder, interval, maxInterval string
+	var replayDirVsFiles, replayMaxFiles, replayDelayScan int
+	fs.StringVar(&folder, "folder", "", "Only replay events of this folder ID")
+	fs.StringVar(&interval, "interval", "", "Override the recorded accumulation interval")
+	fs.StringVar(&maxInterval, "max-interval", "", "Override the recorded maximum accumulation interval")
+	fs.IntVar(&replayDirVsFiles, "dir-vs-files", 0, "Override the recorded number of changes after which a directory is scanned")
+	fs.IntVar(&replayMaxFiles, "max-files", 0, "Override the recorded maximum number of tracked changes")
+	fs.IntVar(&replayDelayScan, "delay-scan", 0, "Override the recorded delay scan interval (in seconds)")
+	fs.Usage = usageFor(fs, replayUsage, replayExtraUsage)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	fd, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer fd.Close()
+	override := func(s *recordedEvent) {
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "interval":
+				s.Interval = interval
+			case "max-interval":
+				s.MaxInterval = maxInterval
+			case "dir-vs-files":
+				s.DirVsFiles = replayDirVsFiles
+			case "max-files":
+				s.MaxFiles = replayMaxFiles
+			case "delay-scan":
+				s.DelayScan = replayDelayScan
+			}
+		})
+	}
+	if err := replayRecording(fd, folder, os.Stdout, override); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+const replayExtraUsage = `
+A recording is created by running syncthing-inotify with -record. The replay
+feeds the recorded events into the same accumulation logic using a virtual
+clock and prints every scan request that would have been sent to Syncthing,
+prefixed with the time since the folder was watched. Requests for ".stfolder"
+only ask Syncthing to delay its next full scan.`
@@ -0,0 +1,114 @@
+// record_test.go
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	initTestDir()
+	defer clearTestDir()
+	recording := filepath.Join(testDirectory, "events.rec")
+	r, err := newEventRecorder(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestPath(t, "file1")
+	r.recordFolder("test1", testDirectory, debounceTimeout, false, false)
+	r.recordST("test1", STEvent{Path: "remote1"})
+	r.recordFS("test1", testDirectory, FSEvent{Path: "remote1"})
+	r.recordFS("test1", testDirectory, FSEvent{Path: "file1"})
+	r.fd.Close()
+
+	fd, err := os.Open(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	settings, events, err := readRecording(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := settings["test1"]; s.FolderPath != testDirectory || s.DirVsFiles != dirVsFiles || s.Interval != debounceTimeout.String() {
+		t.Errorf("Invalid recorded settings: %#v", s)
+	}
+	evs := events["test1"]
+	if len(evs) != 3 || evs[0].Kind != "st" || evs[0].Path != "remote1" ||
+		evs[1].Status != "deleted" || evs[2].Kind != "fs" || evs[2].Path != "file1" || evs[2].Status != "file" {
+		t.Errorf("Invalid recorded events: %#v", evs)
+	}
+}
+
+func TestReplayFullScan(t *testing.T) {
+	initTestDir()
+	defer clearTestDir()
+	recording := filepath.Join(testDirectory, "events.rec")
+	r, err := newEventRecorder(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A full scan requested when catching up is not a change of the folder root
+	r.recordFolder("test1", testDirectory, debounceTimeout, false, false)
+	r.recordFullScan("test1")
+	r.fd.Close()
+
+	bs, err := ioutil.ReadFile(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, events, err := readRecording(bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evs := events["test1"]; len(evs) != 1 || evs[0].Kind != "full" {
+		t.Errorf("Invalid recorded events: %#v", evs)
+	}
+	var out bytes.Buffer
+	replayFolder(&out, settings["test1"], events["test1"])
+	if !strings.Contains(out.String(), "test1 [\"\"]") {
+		t.Errorf("Expected a full scan in replay:\n%s", out.String())
+	}
+}
+
+func TestReplayRecordings(t *testing.T) {
+	// Each recording in testdata is replayed and compared with the expected scan requests
+	expected := map[string]string{
+		"echo.rec": "Replaying 6 events of test1 (interval 100ms, dir-vs-files 10, max-files 512, delay-scan 0)\n" +
+			"    +700ms test1 [\"b/local\"]\n",
+	}
+	for name, exp := range expected {
+		bs, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := replayRecording(bytes.NewReader(bs), "", &out, nil); err != nil {
+			t.Errorf("Failed to replay %s: %v", name, err)
+		}
+		if out.String() != exp {
+			t.Errorf("Unexpected replay of %s:\n%s\nexpected:\n%s", name, out.String(), exp)
+		}
+	}
+	if delayScan != 3600 || maxFiles != 512 {
+		t.Error("Replay did not restore settings")
+	}
+	// Settings overridden for a replay are restored as well
+	bs, err := ioutil.ReadFile(filepath.Join("testdata", "echo.rec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	urlLength := maxScanURLLength
+	if err := replayRecording(bytes.NewReader(bs), "", ioutil.Discard, func(s *recordedEvent) {
+		s.MaxURLLength = urlLength / 2
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if maxScanURLLength != urlLength {
+		t.Errorf("Replay did not restore the maximum URL length %d, got %d", urlLength, maxScanURLLength)
+	}
+}
@@ -0,0 +1,221 @@
+// state.go
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// folderState is checkpointed in the state directory (-state-dir) for every folder
+type folderState struct {
+	// All changes before this time were informed about or are pending
+	LastInformed time.Time `json:"lastInformed"`
+	// Time of the last successful scan request
+	LastScan time.Time `json:"lastScan,omitempty"`
+	// Changes which were not informed about yet, "" if the entire folder has to be scanned
+	Pending []string `json:"pending,omitempty"`
+}
+
+// syncthingState is checkpointed in the state directory next to the folder states
+type syncthingState struct {
+	// ID of the last Syncthing event passed to the folders
+	LastEventID int `json:"lastEventID"`
+}
+
+// Catch-up modes for changes that happened while syncthing-inotify was not running
+const (
+	catchUpChanged = "changed" // Scan files modified since the last inform
+	catchUpFull    = "full"    // Scan entire folders
+	catchUpOff     = "off"
+)
+
+// catchUpSlack accounts for the resolution of modification times on some filesystems
+const catchUpSlack = 2 * time.Second
+
+// checkpointInterval is the minimum time between checkpoints of pending changes and event IDs
+const checkpointInterval = 10 * time.Second
+
+// resumeState is passed to an accumulator once the changes to catch up with are known
+type resumeState struct {
+	paths []string                // Changes to catch up with, "" for the entire folder
+	save  func(state folderState) // Checkpoints the state of the folder
+}
+
+func folderStatePath(dir string, folder string) string {
+	return filepath.Join(dir, url.QueryEscape(folder)+".json")
+}
+
+func syncthingStatePath(dir string) string {
+	// Folder states always end with .json
+	return filepath.Join(dir, "syncthing.state")
+}
+
+// loadFolderState reads the checkpointed state of folder from dir. Returns os.IsNotExist errors for unknown folders.
+func loadFolderState(dir string, folder string) (folderState, error) {
+	var state folderState
+	err := loadState(folderStatePath(dir, folder), &state)
+	return state, err
+}
+
+// saveFolderState checkpoints the state of folder in dir
+func saveFolderState(dir string, folder string, state folderState) error {
+	return saveState(folderStatePath(dir, folder), state)
+}
+
+func loadState(path string, state interface{}) error {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, state)
+}
+
+// saveState writes state as JSON to path, replacing the previous checkpoint atomically
+func saveState(path string, state interface{}) error {
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	fd, err := ioutil.TempFile(filepath.Dir(path), "tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(bs)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), path)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
+}
+
+// resumeEventID returns the ID of the last Syncthing event seen before a restart. Returns 0 if it is
+// unknown or if Syncthing restarted in the meantime, as event IDs start over then.
+func (st *stInstance) resumeEventID() int {
+	if len(st.stateDir) == 0 {
+		return 0
+	}
+	var state syncthingState
+	if err := loadState(syncthingStatePath(st.stateDir), &state); err != nil {
+		if !os.IsNotExist(err) {
+			Warning.Println("Failed to load state of "+st.String()+":", err)
+		}
+		return 0
+	}
+	latest, err := st.getLatestEventID()
+	if err != nil {
+		return 0
+	}
+	if latest < state.LastEventID {
+		// A restarted Syncthing that already passed the previous ID cannot be told apart
+		Debug.Printf("%v restarted (latest event %d, last seen %d), not resuming events", st, latest, state.LastEventID)
+		return 0
+	}
+	OK.Printf("Resuming events of %v after %d", st, state.LastEventID)
+	return state.LastEventID
+}
+
+// eventCheckpointer saves the ID of the last event seen at most every checkpointInterval
+type eventCheckpointer struct {
+	st       *stInstance
+	lastSave time.Time
+}
+
+func (c *eventCheckpointer) seen(id int) {
+	if len(c.st.stateDir) == 0 || time.Since(c.lastSave) < checkpointInterval {
+		return
+	}
+	c.lastSave = time.Now()
+	if err := saveState(syncthingStatePath(c.st.stateDir), syncthingState{LastEventID: id}); err != nil {
+		Warning.Println("Failed to save state of "+c.st.String()+":", err)
+	}
+}
+
+// changedSince walks folderPath and returns the relative paths of files modified after since.
+// Ignored paths are skipped. Stops after limit paths were found. Deleted and renamed files cannot
+// be found this way, they are left to the rescan interval of Syncthing (or -catch-up=full).
+func changedSince(folderPath string, since time.Time, ignored func(relPath string) bool, limit int) ([]string, error) {
+	var paths []string
+	_, err := walkBelow(folderPath, func(relPath string, info os.FileInfo) error {
+		if ignored(relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && info.ModTime().After(since) {
+			paths = append(paths, relPath)
+			if len(paths) >= limit {
+				return errStopWalk
+			}
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// catchUp looks for changes of folder that happened while syncthing-inotify was not running and
+// passes them to resume together with the changes which were pending before, once. The folder
+// root ("") requests a full scan. Nothing is passed if st keeps no state.
+func (st *stInstance) catchUp(folder FolderConfiguration, folderPath string, ignored func(relPath string) bool, resume chan resumeState) {
+	if len(st.stateDir) == 0 {
+		return
+	}
+	save := func(state folderState) {
+		if err := saveFolderState(st.stateDir, folder.ID, state); err != nil {
+			Warning.Println("Failed to save state of "+folder.Label+":", err)
+		}
+	}
+	state, err := loadFolderState(st.stateDir, folder.ID)
+	if os.IsNotExist(err) {
+		// Changes are observed from now on
+		Debug.Println("No previous state for " + folder.Label + ", nothing to catch up")
+		resume <- resumeState{save: save}
+		return
+	}
+	mode := catchUpMode
+	if err != nil {
+		Warning.Println("Failed to load state of "+folder.Label+", requesting a full scan:", err)
+		mode = catchUpFull
+	}
+	if !state.LastScan.IsZero() {
+		Debug.Printf("Last successful scan of %s at %v", folder.Label, state.LastScan)
+	}
+	paths := state.Pending
+	switch mode {
+	case catchUpFull:
+		OK.Println("Requesting a full scan of " + folder.Label + " to catch up with changes")
+		paths = []string{""}
+	case catchUpChanged:
+		since := state.LastInformed.Add(-catchUpSlack)
+		// Changes are not collected beyond maxFiles, a full scan is cheaper than walking the folder for longer
+		changed, err := changedSince(folderPath, since, ignored, maxFiles+1)
+		if err != nil {
+			Warning.Println("Failed to look for changes in "+folder.Label+", requesting a full scan:", err)
+			changed = []string{""}
+		} else if len(changed) > maxFiles {
+			changed = []string{""}
+		}
+		OK.Printf("Catching up with %d changes in %s since %v", len(changed), folder.Label, since)
+		paths = append(paths, changed...)
+	}
+	if len(state.Pending) > 0 {
+		OK.Printf("Resuming %d pending changes in %s", len(state.Pending), folder.Label)
+	}
+	for _, path := range paths {
+		if path == "" {
+			recorder.recordFullScan(st.folderKey(folder.ID))
+		} else {
+			recorder.recordFS(st.folderKey(folder.ID), folderPath, FSEvent{Path: path})
+		}
+	}
+	resume <- resumeState{paths: paths, save: save}
+}
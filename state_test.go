@@ -0,0 +1,274 @@
+// state_test.go
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testStateDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFolderState(t *testing.T) {
+	dir, cleanup := testStateDir(t)
+	defer cleanup()
+	if _, err := loadFolderState(dir, "a/b"); !os.IsNotExist(err) {
+		t.Fatal("Expected no state, got", err)
+	}
+	saved := folderState{LastInformed: time.Date(2016, 1, 2, 3, 4, 5, 6, time.UTC), Pending: []string{"a", "b/c"}}
+	if err := saveFolderState(dir, "a/b", saved); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadFolderState(dir, "a/b")
+	if err != nil || !loaded.LastInformed.Equal(saved.LastInformed) || !slicesEqual(loaded.Pending, saved.Pending) {
+		t.Errorf("Expected %v, got %v (%v)", saved, loaded, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected a single state file, got %d", len(files))
+	}
+}
+
+func TestChangedSince(t *testing.T) {
+	initTestDir()
+	defer clearTestDir()
+	since := time.Now().Add(-time.Hour)
+	files := createTestPaths(t, "new", "a/new", "a/old", "ignored/new", "old")
+	for _, f := range []string{"a/old", "old"} {
+		if err := os.Chtimes(testDirectory+f, since.Add(-time.Minute), since.Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ignored := func(relPath string) bool {
+		return relPath == "ignored"
+	}
+	paths, err := changedSince(testDirectory, since, ignored, 10)
+	expected := []string{files[1], files[0]}
+	if err != nil || !slicesEqual(paths, expected) {
+		t.Errorf("Expected %v, got %v (%v)", expected, paths, err)
+	}
+	paths, err = changedSince(testDirectory, since, ignored, 1)
+	if err != nil || len(paths) != 1 {
+		t.Errorf("Expected a single change, got %v (%v)", paths, err)
+	}
+}
+
+func TestInformedUntil(t *testing.T) {
+	// Changes which were not informed about yet are caught up with after a restart
+	testFiles := createTestPaths(t, "file1", "file2")
+	defer clearTestDir()
+	clock := &virtualClock{now: time.Now()}
+	start := clock.now
+	var saved []folderState
+	a := newChangeAccumulator(clock, 100*time.Millisecond, "test1", testDirectory, 10, func(string, []string) error {
+		return nil
+	})
+	a.startScan = func(int, []string) {}
+	a.saveState = func(state folderState) {
+		saved = append(saved, state)
+	}
+	a.fsEvent(testFiles[0])
+	clock.now = clock.now.Add(200 * time.Millisecond)
+	a.flush()
+	clock.now = clock.now.Add(50 * time.Millisecond)
+	a.fsEvent(testFiles[1])
+	a.scanFinished(1, nil)
+	if len(saved) != 1 || !saved[0].LastInformed.Equal(start.Add(200*time.Millisecond)) {
+		t.Fatalf("Expected state with the time of the scan request, got %v", saved)
+	}
+	clock.now = clock.now.Add(200 * time.Millisecond)
+	a.flush()
+	clock.now = clock.now.Add(50 * time.Millisecond)
+	a.fsEvent(testFiles[0])
+	a.stEvent(STEvent{State: "scanning"})
+	a.stEvent(STEvent{State: "idle"})
+	if len(saved) != 2 || !saved[1].LastInformed.Equal(start.Add(450*time.Millisecond)) {
+		t.Errorf("Expected state with the time of the scan request, got %v", saved)
+	}
+}
+
+func TestCheckpointPendingChanges(t *testing.T) {
+	clock := &virtualClock{now: time.Now()}
+	var saved []folderState
+	a := newChangeAccumulator(clock, 100*time.Millisecond, "test1", testDirectory, 10, func(string, []string) error {
+		return nil
+	})
+	a.saveState = func(state folderState) {
+		saved = append(saved, state)
+	}
+	a.stEvent(STEvent{Path: "remote"})
+	a.fsEvent("b")
+	clock.now = clock.now.Add(time.Second)
+	a.fsEvent("a")
+	if !a.stateDirty {
+		t.Fatal("Tracked changes not marked for a checkpoint")
+	}
+	a.checkpoint(clock.now)
+	if len(saved) != 1 || !slicesEqual(saved[0].Pending, []string{"a", "b"}) || !saved[0].LastInformed.Equal(clock.now.Add(-time.Second)) {
+		t.Fatalf("Expected pending changes since the first change, got %v", saved)
+	}
+	oldMaxFiles := maxFiles
+	defer func() {
+		maxFiles = oldMaxFiles
+	}()
+	maxFiles = 2
+	a.fsEvent("c")
+	a.fsEvent("d")
+	a.checkpoint(clock.now)
+	if len(saved) != 2 || !slicesEqual(saved[1].Pending, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("Expected changes beyond maxFiles to be pending, got %v", saved)
+	}
+	a.fsEvent("e")
+	a.checkpoint(clock.now)
+	if len(saved) != 3 || !slicesEqual(saved[2].Pending, []string{""}) {
+		t.Errorf("Expected a pending full scan, got %v", saved)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	st := newSTInstance("")
+	var cleanup func()
+	st.stateDir, cleanup = testStateDir(t)
+	defer cleanup()
+	initTestDir()
+	defer clearTestDir()
+	folder := FolderConfiguration{ID: "id1", Label: "label1"}
+	notIgnored := func(string) bool {
+		return false
+	}
+	resume := make(chan resumeState, 1)
+	st.catchUp(folder, testDirectory, notIgnored, resume)
+	if r := <-resume; r.paths != nil || r.save == nil {
+		t.Errorf("Expected nothing to catch up without previous state, got %v", r.paths)
+	}
+	since := time.Now().Add(-time.Hour)
+	createTestPaths(t, "new", "old")
+	if err := os.Chtimes(testDirectory+"old", since.Add(-time.Minute), since.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveFolderState(st.stateDir, folder.ID, folderState{LastInformed: since, Pending: []string{"deleted"}}); err != nil {
+		t.Fatal(err)
+	}
+	modes := []struct {
+		mode     string
+		expected []string
+	}{
+		{catchUpChanged, []string{"deleted", "new"}},
+		{catchUpFull, []string{""}},
+		{catchUpOff, []string{"deleted"}},
+	}
+	defer func(mode string) {
+		catchUpMode = mode
+	}(catchUpMode)
+	for _, m := range modes {
+		catchUpMode = m.mode
+		st.catchUp(folder, testDirectory, notIgnored, resume)
+		if r := <-resume; !slicesEqual(r.paths, m.expected) {
+			t.Errorf("Expected %v for catch-up mode %s, got %v", m.expected, m.mode, r.paths)
+		}
+	}
+}
+
+func TestResumeEventID(t *testing.T) {
+	st := newFakeSyncthing()
+	defer st.use()()
+	var cleanup func()
+	st.inst.stateDir, cleanup = testStateDir(t)
+	defer cleanup()
+	if id := st.inst.resumeEventID(); id != 0 {
+		t.Errorf("Expected to start from 0 without previous state, got %d", id)
+	}
+	st.addEvent("Starting", nil)
+	st.addEvent("StartupComplete", nil)
+	checkpointer := eventCheckpointer{st: st.inst}
+	checkpointer.seen(2)
+	checkpointer.seen(1) // Ignored until checkpointInterval passed
+	st.addEvent("Ping", nil)
+	if id := st.inst.resumeEventID(); id != 2 {
+		t.Errorf("Expected to resume after 2, got %d", id)
+	}
+	// Event IDs start over when Syncthing restarts
+	if err := saveState(syncthingStatePath(st.inst.stateDir), syncthingState{LastEventID: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if id := st.inst.resumeEventID(); id != 0 {
+		t.Errorf("Expected to start from 0 after Syncthing restarted, got %d", id)
+	}
+}
+
+func TestResumeFullScan(t *testing.T) {
+	clock := &virtualClock{now: time.Now()}
+	var requests [][]string
+	a := newChangeAccumulator(clock, 100*time.Millisecond, "test1", testDirectory, 10, func(string, []string) error {
+		return nil
+	})
+	a.startScan = func(id int, subs []string) {
+		requests = append(requests, subs)
+	}
+	var saved []folderState
+	a.saveState = func(state folderState) {
+		saved = append(saved, state)
+	}
+	a.requestFullScan()
+	a.checkpoint(clock.now)
+	if len(saved) != 1 || !slicesEqual(saved[0].Pending, []string{""}) {
+		t.Fatalf("Expected a pending full scan, got %v", saved)
+	}
+	clock.now = clock.now.Add(200 * time.Millisecond)
+	a.flush()
+	if len(requests) != 1 || !slicesEqual(requests[0], []string{""}) {
+		t.Fatalf("Expected a full scan, got %v", requests)
+	}
+	a.scanFinished(1, nil)
+	if a.fullScan || len(saved) != 2 || len(saved[1].Pending) != 0 {
+		t.Errorf("Full scan still pending after it succeeded: %v", saved)
+	}
+}
+
+func TestCatchUpFull(t *testing.T) {
+	// -catch-up=full requests a scan of the entire folder
+	st := newSTInstance("")
+	var cleanup func()
+	st.stateDir, cleanup = testStateDir(t)
+	defer cleanup()
+	defer func(mode string) {
+		catchUpMode = mode
+	}(catchUpMode)
+	catchUpMode = catchUpFull
+	if err := saveFolderState(st.stateDir, "test1", folderState{LastInformed: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	resume := make(chan resumeState, 1)
+	st.catchUp(FolderConfiguration{ID: "test1", Label: "test1"}, testDirectory, func(string) bool {
+		return false
+	}, resume)
+	if r := <-resume; !slicesEqual(r.paths, []string{""}) {
+		t.Fatalf("Expected the folder root, got %q", r.paths)
+	}
+	clock := &virtualClock{now: time.Now()}
+	var requests [][]string
+	a := newChangeAccumulator(clock, 100*time.Millisecond, "test1", testDirectory, 10, func(string, []string) error {
+		return nil
+	})
+	a.startScan = func(id int, subs []string) {
+		requests = append(requests, subs)
+	}
+	a.requestFullScan()
+	clock.now = clock.now.Add(200 * time.Millisecond)
+	a.flush()
+	if len(requests) != 1 || !slicesEqual(requests[0], []string{""}) {
+		t.Fatalf("Expected a full scan, got %v", requests)
+	}
+	a.scanFinished(1, nil)
+	if a.fullScan {
+		t.Error("Full scan still pending after it succeeded")
+	}
+}
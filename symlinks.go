@@ -0,0 +1,147 @@
+// symlinks.go
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// followSymlinks enables watching the targets of symlinked directories inside of folders (-follow-symlinks)
+var followSymlinks bool
+
+// symlinkTarget is a directory outside of a folder which is watched for the symlink relPath inside of it
+type symlinkTarget struct {
+	target  string // Real path of the directory
+	relPath string // Path of the symlink, relative to the folder
+}
+
+// symlinkTargets are the watched targets of the symlinks in a folder
+type symlinkTargets []symlinkTarget
+
+// relativePaths maps a path within the targets back to the folder, once for every symlink leading to it
+func (l symlinkTargets) relativePaths(path string) []string {
+	var relPaths []string
+	for _, t := range l {
+		relPath, ok := trimFolder(path, t.target)
+		if !ok {
+			continue
+		}
+		if relPath == "" {
+			relPaths = append(relPaths, t.relPath)
+		} else {
+			relPaths = append(relPaths, t.relPath+pathSeparator+relPath)
+		}
+	}
+	return relPaths
+}
+
+// to returns the symlinks leading to target
+func (l symlinkTargets) to(target string) symlinkTargets {
+	var links symlinkTargets
+	for _, t := range l {
+		if t.target == target {
+			links = append(links, t)
+		}
+	}
+	return links
+}
+
+// contains reports whether path is located in one of the targets
+func (l symlinkTargets) contains(path string) bool {
+	for _, t := range l {
+		if _, ok := trimFolder(path, t.target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// findSymlinkTargets returns the targets of all symlinked directories in folderPath which are not ignored
+func findSymlinkTargets(folderPath string, ignored func(relPath string) bool) symlinkTargets {
+	var targets symlinkTargets
+	for _, link := range findSymlinks(folderPath, "", ignored) {
+		targets = append(targets, followSymlink(link.target, link.relPath, folderPath, targets, ignored)...)
+	}
+	return targets
+}
+
+// followSymlink returns the target of the symlink at path, relPath in the folder, and the targets of the
+// symlinks within it. A target which is already watched for another symlink is returned for this one as
+// well, the symlinks within it are only followed once. Targets inside of the folder or a watched target
+// are already watched, targets containing the folder would watch it again and targets on the way to
+// the symlink are cycles, so they are skipped.
+func followSymlink(path string, relPath string, folderPath string, watched symlinkTargets, ignored func(relPath string) bool) symlinkTargets {
+	type link struct {
+		symlinkTarget
+		route []string // Targets followed to reach the symlink
+	}
+	var found symlinkTargets
+	links := []link{{symlinkTarget: symlinkTarget{path, relPath}}}
+	for len(links) > 0 {
+		l := links[0]
+		links = links[1:]
+		target, err := realPath(l.target)
+		if err != nil {
+			// Dangling symlink
+			continue
+		}
+		if info, err := os.Stat(target); err != nil || !info.IsDir() {
+			continue
+		}
+		_, inFolder := trimFolder(target, folderPath)
+		_, containsFolder := trimFolder(folderPath, target)
+		if inFolder || containsFolder || onRoute(l.route, target) {
+			Debug.Println("Not following " + l.target + " to " + target + ", it is already watched")
+			continue
+		}
+		if len(watched.to(target)) > 0 || len(found.to(target)) > 0 {
+			Debug.Println("Following " + l.target + " to " + target + ", which is already watched")
+			found = append(found, symlinkTarget{target: target, relPath: l.relPath})
+			continue
+		}
+		if watched.contains(target) || found.contains(target) {
+			Debug.Println("Not following " + l.target + " to " + target + ", it is already watched")
+			continue
+		}
+		Debug.Println("Following " + l.target + " to " + target)
+		found = append(found, symlinkTarget{target: target, relPath: l.relPath})
+		route := append(append([]string(nil), l.route...), target)
+		for _, s := range findSymlinks(target, l.relPath, ignored) {
+			links = append(links, link{symlinkTarget: s, route: route})
+		}
+	}
+	return found
+}
+
+// onRoute reports whether target is one of the targets in route or contains one
+func onRoute(route []string, target string) bool {
+	for _, r := range route {
+		if _, ok := trimFolder(r, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// findSymlinks returns the symlinks below dir, which is relDir in the folder. The target of the
+// returned symlinkTargets is the path of the symlink itself, not yet resolved.
+func findSymlinks(dir string, relDir string, ignored func(relPath string) bool) []symlinkTarget {
+	var links []symlinkTarget
+	walkBelow(dir, func(dirRelPath string, info os.FileInfo) error {
+		relPath := dirRelPath
+		if len(relDir) > 0 {
+			relPath = relDir + pathSeparator + dirRelPath
+		}
+		if ignored(relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			links = append(links, symlinkTarget{target: filepath.Join(dir, dirRelPath), relPath: relPath})
+		}
+		return nil
+	})
+	return links
+}
@@ -0,0 +1,125 @@
+// symlinks_test.go
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/syncthing/syncthing/lib/ignore"
+	"github.com/zillode/notify"
+)
+
+// createSymlink creates a symlink at link to target. The target is made absolute, as a relative
+// target would be resolved from the directory of the link.
+func createSymlink(t *testing.T, target string, link string) {
+	t.Helper()
+	target, err := filepath.Abs(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip("Symlinks are not supported", err)
+	}
+}
+
+func TestFindSymlinkTargets(t *testing.T) {
+	createTestPaths(t, "folder"+slash+"dir"+slash+"file", "folder"+slash+"ignored"+slash, "outside"+slash+"a"+slash+"file",
+		"outside"+slash+"b"+slash, "other"+slash+"file")
+	defer clearTestDir()
+	links := [][2]string{
+		{"outside" + slash + "a", "folder" + slash + "la"},
+		{"outside" + slash + "b", "outside" + slash + "a" + slash + "lb"},    // Followed from la
+		{"outside" + slash + "a", "outside" + slash + "b" + slash + "lloop"}, // Cycle
+		{"outside" + slash + "a", "folder" + slash + "ldup"},                 // Same target as la
+		{"folder", "folder" + slash + "dir" + slash + "lin"},                 // Inside of the folder
+		{"", "folder" + slash + "lparent"},                                   // Contains the folder
+		{"missing", "folder" + slash + "ldangling"},                          // Dangling
+		{"other", "folder" + slash + "ignored" + slash + "lother"},           // Ignored
+		{"other" + slash + "file", "folder" + slash + "lfile"},               // Not a directory
+	}
+	for _, l := range links {
+		createSymlink(t, testDirectory+l[0], testDirectory+l[1])
+	}
+	root, err := realPath(testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := findSymlinkTargets(root+slash+"folder", func(relPath string) bool {
+		return relPath == "ignored"
+	})
+	expected := symlinkTargets{
+		{root + slash + "outside" + slash + "a", "la"},
+		{root + slash + "outside" + slash + "b", "la" + slash + "lb"},
+		{root + slash + "outside" + slash + "a", "ldup"},
+	}
+	if len(targets) != len(expected) {
+		t.Fatalf("Expected targets %v, got %v", expected, targets)
+	}
+	for i := range targets {
+		if targets[i] != expected[i] {
+			t.Errorf("Expected targets %v, got %v", expected, targets)
+		}
+	}
+
+	cases := []struct {
+		path     string
+		expected []string
+	}{
+		{root + slash + "outside" + slash + "a" + slash + "file", []string{"la" + slash + "file", "ldup" + slash + "file"}},
+		{root + slash + "outside" + slash + "a", []string{"la", "ldup"}},
+		{root + slash + "outside" + slash + "b" + slash + "new", []string{"la" + slash + "lb" + slash + "new"}},
+		{root + slash + "outside" + slash + "ab", nil},
+		{root + slash + "other" + slash + "file", nil},
+	}
+	for _, c := range cases {
+		if relPaths := targets.relativePaths(c.path); !reflect.DeepEqual(relPaths, c.expected) {
+			t.Errorf("Expected %s to be %q, got %q", c.path, c.expected, relPaths)
+		}
+	}
+}
+
+func TestSymlinkWatcherChanged(t *testing.T) {
+	createTestPaths(t, "folder"+slash, "outside"+slash+"a"+slash, "outside"+slash+"b"+slash)
+	defer clearTestDir()
+	for _, l := range []string{"la", "ldup"} {
+		createSymlink(t, testDirectory+"outside"+slash+"a", testDirectory+"folder"+slash+l)
+	}
+	root, err := realPath(testDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folderPath := root + slash + "folder"
+	a, b := root+slash+"outside"+slash+"a", root+slash+"outside"+slash+"b"
+	st := &stInstance{}
+	links := st.watchSymlinks(FolderConfiguration{Label: "folder"}, folderPath, make(chan notify.EventInfo, maxFiles), ignore.New(false))
+	defer links.stop()
+	expect := func(targets symlinkTargets, watched ...string) {
+		t.Helper()
+		if !reflect.DeepEqual(links.targets, targets) {
+			t.Errorf("Expected targets %v, got %v", targets, links.targets)
+		}
+		if len(links.stops) != len(watched) {
+			t.Errorf("Expected watches of %v, got %d", watched, len(links.stops))
+		}
+		for _, target := range watched {
+			if _, ok := links.stops[target]; !ok {
+				t.Errorf("Expected %s to be watched", target)
+			}
+		}
+	}
+	expect(symlinkTargets{{a, "la"}, {a, "ldup"}}, a)
+
+	// The target is still watched for ldup
+	os.Remove(folderPath + slash + "la")
+	links.changed(folderPath+slash+"la", "la")
+	expect(symlinkTargets{{a, "ldup"}}, a)
+
+	os.Remove(folderPath + slash + "ldup")
+	if err := os.Symlink(b, folderPath+slash+"ldup"); err != nil {
+		t.Fatal(err)
+	}
+	links.changed(folderPath+slash+"ldup", "ldup")
+	expect(symlinkTargets{{b, "ldup"}}, b)
+}
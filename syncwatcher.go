@@ -4,7 +4,6 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
@@ -16,7 +15,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
@@ -24,13 +22,16 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"text/tabwriter"
 	"time"
+	"unicode"
 
 	"github.com/cenkalti/backoff"
 	"github.com/syncthing/syncthing/lib/ignore"
 	"github.com/zillode/notify"
+	"golang.org/x/text/unicode/norm"
 )
 
 // Configuration is used in parsing response from ST
@@ -41,10 +42,15 @@ type Configuration struct {
 
 // FolderConfiguration holds information about shared folder in ST
 type FolderConfiguration struct {
-	ID              string
-	Label           string
-	Path            string
-	RescanIntervalS int
+	ID               string
+	Label            string
+	Path             string
+	RescanIntervalS  int
+	FSWatcherEnabled bool
+	Paused           bool
+	Type             string
+	AutoNormalize    bool // Syncthing converts names to NFC
+	CaseSensitiveFS  bool // Syncthing does not treat names which only differ in case as the same
 }
 
 // Pattern holds ignored path and a boolean which value is false when we should use the pattern in exclude mode
@@ -63,8 +69,21 @@ type Event struct {
 
 // STEvent holds simplified data for Syncthing event. Path can be empty in the case of event.type="RemoteIndexUpdated"
 type STEvent struct {
-	Path     string
-	Finished bool
+	Path      string
+	Finished  bool
+	Overflow  bool      // Events were dropped because too many were queued for the folder
+	Restarted bool      // Syncthing restarted, events of scans it was running are lost
+	State     string    // New state of the folder for event.type="StateChanged"
+	Time      time.Time // Time of a StateChanged event in Syncthing, zero if unknown
+	Paused    bool      // The folder was paused
+	Resumed   bool      // The folder was resumed
+}
+
+// FSEvent is a change of Path (relative to the folder) observed on the filesystem
+type FSEvent struct {
+	Path    string
+	Writing bool // Path was written to and is probably still open (-write-timeout)
+	Closed  bool // A writer closed Path (-write-timeout)
 }
 
 // STNestedConfig is used for unpacking config from XML format
@@ -87,28 +106,27 @@ type folderSlice []string
 type progressTime struct {
 	fsEvent bool // true - event was triggered by filesystem, false - by Syncthing
 	time    time.Time
+	first   time.Time // Time of the first change which was not informed about yet
 }
 
 func (fs *folderSlice) String() string {
 	return fmt.Sprint(*fs)
 }
 func (fs *folderSlice) Set(value string) error {
-	for _, f := range strings.Split(value, ",") {
+	// Regular expressions may contain commas
+	values := []string{value}
+	if !strings.HasPrefix(value, regexpPrefix) {
+		values = strings.Split(value, ",")
+	}
+	for _, f := range values {
+		if _, err := matchFolder(f, FolderConfiguration{}); err != nil {
+			return err
+		}
 		*fs = append(*fs, f)
 	}
 	return nil
 }
 
-// HTTP Authentication
-var (
-	target    string
-	authUser  string
-	authPass  string
-	csrfToken string
-	csrfFile  string
-	apiKey    string
-)
-
 // HTTP Timeouts
 var (
 	requestTimeout = 180 * time.Second
@@ -116,33 +134,75 @@ var (
 
 // HTTP Debounce
 var (
-	debounceTimeout   = 500 * time.Millisecond
-	configSyncTimeout = 5 * time.Second
-	fsEventTimeout    = 5 * time.Second
-	dirVsFiles        = 128
-	maxFiles          = 512
+	debounceTimeout    = 500 * time.Millisecond
+	maxDebounceTimeout time.Duration // Adaptive accumulation up to this interval, disabled if not above debounceTimeout
+	maxWait            = time.Minute // Paths which keep changing are informed about after this time, disabled if 0
+	hotInterval        = time.Minute // Paths matching hotPaths are informed about at this cadence
+	hotPaths           []string
+	writeTimeout       time.Duration // Changes of files open for writing are held until closed, at most this long. Disabled if 0.
+	receiveOnlyTimeout = 10 * time.Second
+	scanEndTimeout     = 10 * time.Minute // Wait for Syncthing to report the end of a scan whose request failed
+	configSyncTimeout  = 5 * time.Second
+	fsEventTimeout     = 5 * time.Second
+	dirVsFiles         = 128
+	maxFiles           = 512
+	maxScanURLLength   = 8000 // Longer lists of subs are split into several scan requests
+	stQueueSize        = 1024
 )
 
 // Main
 var (
-	stop         = make(chan int)
-	ignorePaths  = []string{".stversions", ".syncthing.", "~syncthing~"}
-	logFd        = os.Stdout
-	Version      = "unknown-dev"
-	Discard      = log.New(ioutil.Discard, "", log.Ldate)
-	Warning      = Discard // verbosity=1
-	OK           = Discard // 2
-	Trace        = Discard // 3
-	Debug        = Discard // 4
-	watchFolders folderSlice
-	skipFolders  folderSlice
-	delayScan    = 3600
+	stop        = make(chan int)
+	ignorePaths = []string{".stversions", ".syncthing.", "~syncthing~"}
+	logFd       = os.Stdout
+	Version     = "unknown-dev"
+	Discard     = log.New(ioutil.Discard, "", log.Ldate)
+	Warning     = Discard // verbosity=1
+	OK          = Discard // 2
+	Trace       = Discard // 3
+	Debug       = Discard // 4
+	instances   []*stInstance
+	delayScan   = 3600
+	stateDir    string
+	catchUpMode = catchUpChanged
+	forceWatch  bool
 )
 
 const (
 	pathSeparator = string(os.PathSeparator)
-	usage         = "syncthing-inotify [options]"
+	usage         = "syncthing-inotify [options]\n  " + explainUsage + "\n  " + replayUsage
 	extraUsage    = `
+Run "syncthing-inotify explain -help" to see how a list of changed paths
+would be aggregated into scan requests. Run "syncthing-inotify replay -help"
+to see how events recorded with -record are replayed.
+
+The -instances file watches several Syncthing instances from one process,
+instead of the instance given by -home, -target, -api and related options:
+
+  [{"name": "alice", "home": "/home/alice/.config/syncthing"},
+   {"name": "bob", "target": "127.0.0.1:8385", "apiKey": "...",
+    "folders": ["photos"]}]
+
+Every instance needs a unique name. Besides "home" and "target", "apiKey",
+"user", "password", "csrf" (a token file), "folders" and "skipFolders" are
+supported. With -state-dir, every instance keeps its state in a subdirectory.
+
+Every item of -folders and -skip-folders is a glob pattern (as in "proj-*")
+which is matched against the ID, the label and the path of a folder. Items
+starting with "re:" are regular expressions which have to match an entire ID,
+label or path instead; such a value is not split at commas. A folder is
+watched if it matches -folders (or -folders is not given) and does not match
+-skip-folders, i.e. -skip-folders takes precedence:
+
+  -folders='proj-*,photos' -skip-folders='re:.*-(tmp|old)'
+
+Changes of a path are informed about once the path did not change for the
+accumulation interval, or after -max-wait if it keeps changing. Paths which
+change all the time, like logs or databases, can be listed in -hot-paths to
+inform about their changes every -hot-interval instead. Patterns without a
+path separator match file names (as in "*.log"), other patterns match paths
+relative to the folder (as in "db/*.sqlite").
+
 The -logflags value is a sum of the following:
 
    1  Date
@@ -157,12 +217,20 @@ show time only (2).`
 )
 
 func init() {
+	if len(os.Args) > 1 && os.Args[1] == "explain" {
+		os.Exit(explainMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayMain(os.Args[2:]))
+	}
+
+	st := newSTInstance("")
 	c, _ := getSTConfig(getSTDefaultConfDir())
 	if !strings.Contains(c.Target, "://") {
 		if c.TLS {
-			target = "https://" + c.Target
+			st.target = "https://" + c.Target
 		} else {
-			target = "http://" + c.Target
+			st.target = "http://" + c.Target
 		}
 	}
 
@@ -173,22 +241,45 @@ func init() {
 	var apiKeyStdin bool
 	var authPassStdin bool
 	var showVersion bool
+	var recordFile string
+	var csrfFile string
+	var instancesFile string
+	var hotPathList string
 	flag.DurationVar(&debounceTimeout, "interval", debounceTimeout,
 		"Accumulation interval, e.g. 5s or 1m")
+	flag.DurationVar(&maxDebounceTimeout, "max-interval", maxDebounceTimeout,
+		"Maximum accumulation interval while changes keep coming in, e.g. 10s (-interval by default)")
+	flag.DurationVar(&maxWait, "max-wait", maxWait,
+		"Inform about paths which keep changing after this time, 0 to wait until they stop changing")
+	flag.StringVar(&hotPathList, "hot-paths", "",
+		"A comma-separated list of patterns of paths which change continuously, e.g. *.log (see below)")
+	flag.DurationVar(&hotInterval, "hot-interval", hotInterval, "Interval at which changes of -hot-paths are informed about")
+	flag.DurationVar(&writeTimeout, "write-timeout", writeTimeout,
+		"Wait until files are closed by their writer, at most this long, e.g. 10m (Linux only, disabled by default)")
+	flag.BoolVar(&followSymlinks, "follow-symlinks", false, "Watch the targets of symlinked directories inside of folders")
+	flag.DurationVar(&receiveOnlyTimeout, "receive-only-interval", receiveOnlyTimeout,
+		"Accumulation interval for receive-only folders, if longer than -interval")
 	flag.StringVar(&logFile, "logfile", "", "Log file")
 	flag.IntVar(&verbosity, "verbosity", 2, "Logging level [1..4]")
 	flag.IntVar(&logflags, "logflags", 2, "Select information in log line prefix")
 	flag.StringVar(&home, "home", home, "Specify the home Syncthing dir to sniff configuration settings")
-	flag.StringVar(&target, "target", target, "Target url (prepend with https:// for TLS)")
-	flag.StringVar(&authUser, "user", c.AuthUser, "Username")
-	flag.StringVar(&authPass, "password", "***", "Password")
+	flag.StringVar(&st.target, "target", st.target, "Target url (prepend with https:// for TLS)")
+	flag.StringVar(&st.authUser, "user", c.AuthUser, "Username")
+	flag.StringVar(&st.authPass, "password", "***", "Password")
 	flag.StringVar(&csrfFile, "csrf", "", "CSRF token file")
-	flag.StringVar(&apiKey, "api", c.APIKey, "API key")
+	flag.StringVar(&st.apiKey, "api", c.APIKey, "API key")
 	flag.BoolVar(&apiKeyStdin, "api-stdin", false, "Provide API key through stdin")
 	flag.BoolVar(&authPassStdin, "password-stdin", false, "Provide password through stdin")
-	flag.Var(&watchFolders, "folders", "A comma-separated list of folder labels or IDs to watch (all by default)")
-	flag.Var(&skipFolders, "skip-folders", "A comma-separated list of folder labels or IDs to skip inotify watching")
+	flag.Var(&st.watchFolders, "folders", "A comma-separated list of folder labels, IDs or paths to watch (all by default), see below")
+	flag.Var(&st.skipFolders, "skip-folders", "A comma-separated list of folder labels, IDs or paths to skip inotify watching, see below")
+	flag.StringVar(&instancesFile, "instances", "", "JSON file listing several Syncthing instances to watch (see below)")
+	flag.BoolVar(&forceWatch, "force-watch", false, "Watch folders even if Syncthing watches them for changes itself (fsWatcherEnabled)")
 	flag.IntVar(&delayScan, "delay-scan", delayScan, "Automatically delay next scan interval (in seconds)")
+	flag.IntVar(&maxScanURLLength, "max-url-length", maxScanURLLength, "Maximum length of scan request URLs, more changes are sent in several requests")
+	flag.IntVar(&stQueueSize, "event-queue-size", stQueueSize, "Maximum number of Syncthing events queued per folder")
+	flag.StringVar(&recordFile, "record", "", "Record filesystem and Syncthing events to a file (see replay)")
+	flag.StringVar(&stateDir, "state-dir", "", "Directory to keep state in between restarts (disabled by default)")
+	flag.StringVar(&catchUpMode, "catch-up", catchUpMode, "How to catch up with changes made while not running (changed, full or off), requires -state-dir")
 	flag.BoolVar(&showVersion, "version", false, "Show version")
 
 	flag.Usage = usageFor(flag.CommandLine, usage, fmt.Sprintf(extraUsage))
@@ -208,86 +299,120 @@ func init() {
 	}
 
 	if verbosity >= 1 {
-		Warning = log.New(logFd, "[WARNING] ", logflags)
+		Warning = log.New(escapingWriter{logFd}, "[WARNING] ", logflags)
 	}
 	if verbosity >= 2 {
-		OK = log.New(logFd, "[OK] ", logflags)
+		OK = log.New(escapingWriter{logFd}, "[OK] ", logflags)
 	}
 	if verbosity >= 3 {
-		Trace = log.New(logFd, "[TRACE] ", logflags)
+		Trace = log.New(escapingWriter{logFd}, "[TRACE] ", logflags)
 	}
 	if verbosity >= 4 {
-		Debug = log.New(logFd, "[DEBUG] ", logflags)
+		Debug = log.New(escapingWriter{logFd}, "[DEBUG] ", logflags)
 	}
 
-	if len(home) > 0 {
-		c, err := getSTConfig(home)
+	if len(recordFile) > 0 {
+		var err error
+		recorder, err = newEventRecorder(recordFile)
 		if err != nil {
 			log.Fatalln(err)
 		}
-		if !strings.Contains(c.Target, "://") {
-			if c.TLS {
-				target = "https://" + c.Target
-			} else {
-				target = "http://" + c.Target
-			}
-			target = strings.Replace(target, "0.0.0.0", "127.0.0.1", 1)
-			apiKey = c.APIKey
+	}
+
+	if len(home) > 0 {
+		if err := st.loadHome(home); err != nil {
+			log.Fatalln(err)
 		}
 	}
-	if !strings.Contains(target, "://") {
-		target = "http://" + target
+	if !strings.Contains(st.target, "://") {
+		st.target = "http://" + st.target
 	}
 	if len(csrfFile) > 0 {
-		fd, err := os.Open(csrfFile)
-		if err != nil {
+		if err := st.loadCsrfFile(csrfFile); err != nil {
 			log.Fatalln(err)
 		}
-		s := bufio.NewScanner(fd)
-		for s.Scan() {
-			csrfToken = s.Text()
-		}
-		fd.Close()
 	}
 	if apiKeyStdin && authPassStdin {
 		log.Fatalln("Either provide an API or password through stdin")
 	}
 	if apiKeyStdin {
 		stdin := bufio.NewReader(os.Stdin)
-		apiKey, _ = stdin.ReadString('\n')
+		st.apiKey, _ = stdin.ReadString('\n')
 	}
 	if authPassStdin {
 		stdin := bufio.NewReader(os.Stdin)
-		authPass, _ = stdin.ReadString('\n')
+		st.authPass, _ = stdin.ReadString('\n')
+	}
+	if len(hotPathList) > 0 {
+		hotPaths = strings.Split(hotPathList, ",")
+		for _, pattern := range hotPaths {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				log.Fatalln("Invalid pattern "+pattern+" in -hot-paths:", err)
+			}
+		}
 	}
-	if len(watchFolders) != 0 && len(skipFolders) != 0 {
-		log.Fatalln("Either provide a list of folders to be watched or to be ignored, not both.")
+	if writeTimeout > 0 && len(writeEvents) == 0 {
+		log.Fatalln("Waiting for writers (-write-timeout) is only supported on Linux.")
+	}
+	if maxDebounceTimeout != 0 && maxDebounceTimeout < debounceTimeout {
+		log.Fatalln("The maximum accumulation interval cannot be shorter than -interval.")
 	}
 	if delayScan > 0 && delayScan < 60 {
 		log.Fatalln("A delay scan interval shorter than 60 is not supported.")
 	}
+	if stQueueSize < 1 {
+		log.Fatalln("The Syncthing event queue of a folder (-event-queue-size) has to hold at least 1 event.")
+	}
+	if catchUpMode != catchUpChanged && catchUpMode != catchUpFull && catchUpMode != catchUpOff {
+		log.Fatalln("Unknown catch-up mode " + catchUpMode)
+	}
+	if len(stateDir) > 0 {
+		stateDir = expandTilde(stateDir)
+		if err := os.MkdirAll(stateDir, 0700); err != nil {
+			log.Fatalln(err)
+		}
+		st.stateDir = stateDir
+	}
+	if len(instancesFile) > 0 {
+		var err error
+		instances, err = readInstances(expandTilde(instancesFile))
+		if err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		instances = []*stInstance{st}
+	}
 }
 
 // main reads configs, starts all gouroutines and waits until a message is in channel stop.
 func main() {
-	backoff.Retry(testWebGuiPost, backoff.NewExponentialBackOff())
 	// Attempt to increase the limit on number of open files to the maximum allowed.
 	MaximizeOpenFileLimit()
 
-	allFolders := getFolders()
-	folders := filterFolders(allFolders)
-	if len(folders) == 0 {
-		log.Fatalln("No folders to be watched, exiting...")
-	}
-	stChans := make(map[string]chan STEvent, len(folders))
-	for _, folder := range folders {
-		Debug.Println("Installing watch for " + folder.Label)
-		stChan := make(chan STEvent)
-		stChans[folder.ID] = stChan
-		go watchFolder(folder, stChan)
+	if len(instances) == 1 {
+		if err := instances[0].watch(); err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		failed := make(chan bool, len(instances))
+		for _, st := range instances {
+			go func(st *stInstance) {
+				err := st.watch()
+				if err != nil {
+					Warning.Println("Not watching "+st.String()+":", err)
+				}
+				failed <- err != nil
+			}(st)
+		}
+		go func() {
+			for range instances {
+				if !<-failed {
+					return
+				}
+			}
+			log.Fatalln("No Syncthing instance could be watched, exiting...")
+		}()
 	}
-	// Note: Lose thread ownership of stChans
-	go watchSTEvents(stChans, allFolders)
 	go listenForSighup()
 
 	code := <-stop
@@ -295,30 +420,73 @@ func main() {
 	os.Exit(code)
 }
 
-// Restart uses path to itself and copy of environment to start new process.
-// Then it sends message to stop channel to shutdown itself.
-func restart() bool {
-	pgm, err := exec.LookPath(os.Args[0])
+// watch connects to st and starts watching its folders. Blocks until st is reachable.
+func (st *stInstance) watch() error {
+	// Syncthing may start long after syncthing-inotify, it is waited for as long as it takes
+	connectBackOff := backoff.NewExponentialBackOff()
+	connectBackOff.MaxElapsedTime = 0
+	backoff.Retry(st.testWebGuiPost, connectBackOff)
+
+	var err error
+	st.capabilities, err = st.getCapabilities()
 	if err != nil {
-		Warning.Println("Cannot restart:", err)
-		return false
+		return err
 	}
-	env := os.Environ()
-	newEnv := make([]string, 0, len(env))
-	for _, s := range env {
-		newEnv = append(newEnv, s)
+	OK.Println("Connected to " + st.String() + " " + st.capabilities.Version)
+	if st.capabilities.FSWatcher && !forceWatch {
+		OK.Println("This version of Syncthing can watch folders for changes itself, folders with fsWatcherEnabled are skipped")
 	}
-	proc, err := os.StartProcess(pgm, os.Args, &os.ProcAttr{
-		Env:   newEnv,
-		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
-	})
+
+	allFolders, err := st.getFolders()
 	if err != nil {
-		Warning.Println("Cannot restart:", err)
-		return false
+		return err
 	}
-	proc.Release()
-	stop <- 3
-	return true
+	folders := st.filterFolders(allFolders)
+	if len(folders) == 0 {
+		return errors.New("No folders to be watched")
+	}
+	go st.run(allFolders, folders)
+	return nil
+}
+
+// run watches folders of st. Once the folder configuration of st changed in Syncthing, st
+// stops watching and starts over with the new configuration; other instances are not
+// affected. It never exits.
+func (st *stInstance) run(allFolders []FolderConfiguration, folders []FolderConfiguration) {
+	for {
+		done := make(chan struct{})
+		configSaved := make(chan struct{}, 1)
+		stopped := st.startWatching(folders, configSaved, done)
+		allFolders = st.waitForFolderChange(allFolders, configSaved)
+		OK.Println("Syncthing folder configuration of " + st.String() + " updated, watching its folders again")
+		close(done)
+		stopped.Wait()
+		folders = st.filterFolders(allFolders)
+	}
+}
+
+// startWatching watches folders until done is closed. configSaved receives a value whenever
+// Syncthing saved its configuration. The returned WaitGroup is done once all watchers stopped.
+func (st *stInstance) startWatching(folders []FolderConfiguration, configSaved chan<- struct{}, done <-chan struct{}) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	stChans := make(map[string]chan STEvent, len(folders))
+	for _, folder := range folders {
+		Debug.Println("Installing watch for " + folder.Label)
+		stChan := make(chan STEvent)
+		stChans[folder.ID] = stChan
+		wg.Add(1)
+		go func(folder FolderConfiguration) {
+			st.watchFolder(folder, stChan, done)
+			wg.Done()
+		}(folder)
+	}
+	wg.Add(1)
+	go func() {
+		// Note: Lose thread ownership of stChans
+		st.watchSTEvents(stChans, configSaved, done)
+		wg.Done()
+	}()
+	return &wg
 }
 
 func listenForSighup() {
@@ -328,37 +496,84 @@ func listenForSighup() {
 	stop <- 0
 }
 
-// filterFolders refines folders list using global vars watchFolders and skipFolders
-func filterFolders(folders []FolderConfiguration) []FolderConfiguration {
-	if len(watchFolders) > 0 {
-		var fs []FolderConfiguration
-		for _, f := range folders {
-			for _, watch := range watchFolders {
-				if f.ID == watch || f.Label == watch {
-					fs = append(fs, f)
-					break
-				}
-			}
+// filterFolders refines folders list using the watchFolders and skipFolders of st and forceWatch.
+// The decision for every folder is logged.
+func (st *stInstance) filterFolders(folders []FolderConfiguration) []FolderConfiguration {
+	var fs []FolderConfiguration
+	for _, f := range folders {
+		watch, reason := st.shouldWatch(f)
+		if watch {
+			OK.Printf("Folder %s will be watched: %s", f.Label, reason)
+			fs = append(fs, f)
+		} else {
+			OK.Printf("Folder %s will not be watched: %s", f.Label, reason)
 		}
-		return fs
 	}
-	if len(skipFolders) > 0 {
-		var fs []FolderConfiguration
-		for _, f := range folders {
-			keep := true
-			for _, skip := range skipFolders {
-				if f.ID == skip || f.Label == skip {
-					keep = false
-					break
-				}
-			}
-			if keep {
-				fs = append(fs, f)
+	return fs
+}
+
+// shouldWatch decides whether folder f needs to be watched and why
+func (st *stInstance) shouldWatch(f FolderConfiguration) (bool, string) {
+	if len(st.watchFolders) > 0 {
+		if _, ok := folderListed(f, st.watchFolders); !ok {
+			return false, "not matched by -folders"
+		}
+	}
+	if pattern, ok := folderListed(f, st.skipFolders); ok {
+		return false, "matched by " + pattern + " in -skip-folders"
+	}
+	if f.FSWatcherEnabled {
+		if !forceWatch {
+			return false, "Syncthing watches it for changes itself (use -force-watch to watch it anyway)"
+		}
+		return true, "Syncthing watches it for changes as well, but -force-watch is set"
+	}
+	if f.Paused {
+		return true, "Syncthing does not watch it for changes, it is paused until resumed"
+	}
+	return true, "Syncthing does not watch it for changes"
+}
+
+// folderListed returns the first pattern in list that matches f
+func folderListed(f FolderConfiguration, list folderSlice) (string, bool) {
+	for _, pattern := range list {
+		// Patterns were validated when they were set
+		if ok, _ := matchFolder(pattern, f); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// regexpPrefix marks items of -folders and -skip-folders which are regular expressions
+const regexpPrefix = "re:"
+
+// matchFolder reports whether pattern matches the ID, label or path of f. Patterns are globs
+// unless they start with regexpPrefix. Returns an error for malformed patterns.
+func matchFolder(pattern string, f FolderConfiguration) (bool, error) {
+	candidates := []string{f.ID, f.Label, expandTilde(f.Path)}
+	if strings.HasPrefix(pattern, regexpPrefix) {
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(pattern, regexpPrefix) + ")$")
+		if err != nil {
+			return false, fmt.Errorf("invalid folder pattern %s: %v", pattern, err)
+		}
+		for _, c := range candidates {
+			if len(c) > 0 && re.MatchString(c) {
+				return true, nil
 			}
 		}
-		return fs
+		return false, nil
+	}
+	for _, c := range candidates {
+		ok, err := filepath.Match(pattern, c)
+		if err != nil {
+			return false, fmt.Errorf("invalid folder pattern %s: %v", pattern, err)
+		}
+		if ok && len(c) > 0 {
+			return true, nil
+		}
 	}
-	return folders
+	return false, nil
 }
 
 func closeRequestResult(result *http.Response) {
@@ -367,86 +582,339 @@ func closeRequestResult(result *http.Response) {
 	}
 }
 
-// getFolders returns the list of folders configured in Syncthing. Blocks until ST responded successfully.
-func getFolders() []FolderConfiguration {
-	Trace.Println("Getting Folders")
-	r, err := http.NewRequest("GET", target+"/rest/system/config", nil)
-	res, err := performRequest(r)
+// getFolders returns the list of folders configured in Syncthing
+func (st *stInstance) getFolders() ([]FolderConfiguration, error) {
+	Trace.Println("Getting Folders of " + st.String())
+	endpoint := "/rest/system/config"
+	if st.capabilities.ConfigFolders {
+		endpoint = "/rest/config/folders"
+	}
+	r, err := http.NewRequest("GET", st.target+endpoint, nil)
+	res, err := st.performRequest(r)
 	defer closeRequestResult(res)
 	if err != nil {
-		log.Fatalln("Failed to perform request /rest/system/config: ", err)
+		return nil, fmt.Errorf("failed to perform request %s: %v", endpoint, err)
 	}
 	if res.StatusCode != 200 {
-		log.Fatalf("Status %d != 200 for GET /rest/system/config: ", res.StatusCode)
+		return nil, fmt.Errorf("status %d != 200 for GET %s", res.StatusCode, endpoint)
 	}
 	bs, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	var cfg Configuration
-	err = json.Unmarshal(bs, &cfg)
+	if st.capabilities.ConfigFolders {
+		err = json.Unmarshal(bs, &cfg.Folders)
+	} else {
+		err = json.Unmarshal(bs, &cfg)
+	}
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	// Use folder label unless it's empty
-	folders := cfg.Folders;
+	folders := cfg.Folders
 	for f := range folders {
 		if len(folders[f].Label) == 0 {
-			folders[f].Label = folders[f].ID;
+			folders[f].Label = folders[f].ID
 		}
 	}
-	return folders;
+	return folders, nil
 }
 
 // watchFolder installs inotify watcher for a folder, launches
-// goroutine which receives changed items. It never exits.
-func watchFolder(folder FolderConfiguration, stInput chan STEvent) {
+// goroutine which receives changed items. The watcher is stopped while the
+// folder is paused. It returns once done is closed and the accumulator stopped.
+func (st *stInstance) watchFolder(folder FolderConfiguration, stInput chan STEvent, done <-chan struct{}) {
 	folderPath, err := realPath(expandTilde(folder.Path))
 	if err != nil {
 		Warning.Println("Failed to install inotify handler for "+folder.Label+".", err)
-		informError("Failed to install inotify handler for " + folder.Label + ": " + err.Error())
+		st.informError("Failed to install inotify handler for " + folder.Label + ": " + err.Error())
 		return
 	}
 	ignores := ignore.New(false)
 	Trace.Println("Getting ignore patterns for " + folder.Label)
 	ignores.Load(filepath.Join(folderPath, ".stignore"))
-	fsInput := make(chan string)
-	c := make(chan notify.EventInfo, maxFiles)
-	ignoreTest := func(absolutePath string) bool {
-		relPath := relativePath(absolutePath, folderPath)
+	fsInput := make(chan FSEvent)
+	accInput := make(chan STEvent)
+	interval := debounceTimeoutFor(folder)
+	// Syncthing defaults caseSensitiveFS to false everywhere, only a case insensitive filesystem changes names in events
+	caseInsensitive := !folder.CaseSensitiveFS && caseInsensitiveFS(folderPath)
+	recorder.recordFolder(st.folderKey(folder.ID), folderPath, interval, folder.AutoNormalize, caseInsensitive)
+	resume := make(chan resumeState, 1)
+	accumulated := make(chan struct{})
+	go func() {
+		accumulateChanges(interval, folder.ID, folderPath, dirVsFiles, accInput, fsInput, resume, st.informChange,
+			pathKeyFor(folder.AutoNormalize, caseInsensitive), done)
+		close(accumulated)
+	}()
+	go st.catchUp(folder, folderPath, func(relPath string) bool {
 		return ignores.Match(relPath).IsIgnored()
+	}, resume)
+	if folder.RescanIntervalS < 1800 && delayScan <= 0 {
+		OK.Printf("The rescan interval of folder %s can be increased to 3600 (an hour) or even 86400 (a day) as changes should be observed immediately while syncthing-inotify is running.", folder.Label)
+	}
+	var c chan notify.EventInfo // nil while the folder is paused
+	var links *symlinkWatcher   // Watches the targets of symlinks (-follow-symlinks)
+	if folder.Paused {
+		OK.Println("Not watching " + folder.Label + " until it is resumed")
+		select {
+		case accInput <- STEvent{Paused: true}:
+		case <-done:
+		}
+	} else if c = st.installWatch(folder, folderPath, ignores); c == nil {
+		<-done
+		<-accumulated
+		return
+	} else if followSymlinks {
+		links = st.watchSymlinks(folder, folderPath, c, ignores)
+	}
+	for {
+		select {
+		case ev := <-c:
+			evAbsolutePath := ev.Path()
+			Debug.Println("Change detected in: " + evAbsolutePath + " (could still be ignored)")
+			// A change in the target of symlinks is reported for every symlink leading to it
+			evRelPaths := links.relativePaths(evAbsolutePath)
+			if len(evRelPaths) == 0 {
+				if evRelPath, ok := folderRelativePath(evAbsolutePath, folderPath); ok {
+					evRelPaths = []string{evRelPath}
+				}
+			}
+			if len(evRelPaths) == 0 {
+				Debug.Println("Ignoring change outside of " + folderPath + ": " + evAbsolutePath)
+				continue
+			}
+			for _, evRelPath := range evRelPaths {
+				if ignores.Match(evRelPath).IsIgnored() {
+					Debug.Println("Ignoring", evAbsolutePath)
+					continue
+				}
+				Trace.Println("Change detected in: " + evAbsolutePath)
+				fsEv := FSEvent{Path: evRelPath}
+				if writeTimeout > 0 {
+					fsEv.Writing, fsEv.Closed = writeState(ev.Event())
+				}
+				recorder.recordFS(st.folderKey(folder.ID), folderPath, fsEv)
+				select {
+				case fsInput <- fsEv:
+				case <-done:
+					continue
+				}
+				if links != nil {
+					// Deleted or retargeted symlinks are dropped, new ones are followed
+					links.changed(evAbsolutePath, evRelPath)
+				}
+			}
+		case ev := <-stInput:
+			if ev.Paused && c != nil {
+				st.stopWatch(c, folderPath, links)
+				c, links = nil, nil
+				OK.Println("Stopped watching " + folder.Label + " as it was paused")
+			}
+			if ev.Resumed && c == nil {
+				c = st.installWatch(folder, folderPath, ignores)
+				if c != nil && followSymlinks {
+					links = st.watchSymlinks(folder, folderPath, c, ignores)
+				}
+			}
+			select {
+			case accInput <- ev:
+			case <-done:
+			}
+		case <-done:
+			if c != nil {
+				st.stopWatch(c, folderPath, links)
+			}
+			<-accumulated
+			Debug.Println("Stopped watching " + folder.Label)
+			return
+		}
 	}
-	notify.SetDoNotWatch(ignoreTest)
-	if err := notify.Watch(filepath.Join(folderPath, "..."), c, notify.All); err != nil {
+}
+
+// stopWatch stops the inotify watcher c of folderPath and the watches of the targets of its symlinks
+func (st *stInstance) stopWatch(c chan notify.EventInfo, folderPath string, links *symlinkWatcher) {
+	links.stop()
+	notify.Stop(c)
+	unregisterIgnores(folderPath)
+}
+
+// installWatch installs an inotify watcher for folderPath. Returns nil if it failed.
+func (st *stInstance) installWatch(folder FolderConfiguration, folderPath string, ignores *ignore.Matcher) chan notify.EventInfo {
+	c := make(chan notify.EventInfo, maxFiles)
+	registerIgnores(folderPath, func(absolutePath string) bool {
+		relPath, ok := folderRelativePath(absolutePath, folderPath)
+		return ok && ignores.Match(relPath).IsIgnored()
+	})
+	notify.SetDoNotWatch(doNotWatch)
+	if err := notify.Watch(filepath.Join(folderPath, "..."), c, watchEvents()...); err != nil {
 		if strings.Contains(err.Error(), "too many open files") || strings.Contains(err.Error(), "no space left on device") {
 			msg := "Failed to install inotify handler for " + folder.Label + ". Please increase inotify limits, see http://bit.ly/1PxkdUC for more information."
 			Warning.Println(msg, err)
-			informError(msg)
-			return
+			st.informError(msg)
+			unregisterIgnores(folderPath)
+			return nil
 		} else {
 			Warning.Println("Failed to install inotify handler for "+folder.Label+".", err)
-			informError("Failed to install inotify handler for " + folder.Label + ": " + err.Error())
-			return
+			st.informError("Failed to install inotify handler for " + folder.Label + ": " + err.Error())
+			unregisterIgnores(folderPath)
+			return nil
 		}
 	}
-	defer notify.Stop(c)
-	go accumulateChanges(debounceTimeout, folder.ID, folderPath, dirVsFiles, stInput, fsInput, informChange)
 	OK.Println("Watching " + folder.Label + ": " + folderPath)
-	if folder.RescanIntervalS < 1800 && delayScan <= 0 {
-		OK.Printf("The rescan interval of folder %s can be increased to 3600 (an hour) or even 86400 (a day) as changes should be observed immediately while syncthing-inotify is running.", folder.Label)
+	return c
+}
+
+// symlinkWatcher watches the targets of the symlinks in a folder (-follow-symlinks). Every target has
+// its own watch, whose events are forwarded to the watch of the folder.
+type symlinkWatcher struct {
+	folder     FolderConfiguration
+	folderPath string
+	c          chan notify.EventInfo // Watch of the folder
+	ignores    *ignore.Matcher
+	targets    symlinkTargets
+	stops      map[string]func() // Stops the watch of a target
+}
+
+// watchSymlinks watches the targets of all symlinks in folder and forwards their events to c
+func (st *stInstance) watchSymlinks(folder FolderConfiguration, folderPath string, c chan notify.EventInfo, ignores *ignore.Matcher) *symlinkWatcher {
+	w := &symlinkWatcher{folder: folder, folderPath: folderPath, c: c, ignores: ignores, stops: make(map[string]func())}
+	w.add(findSymlinkTargets(folderPath, w.ignored))
+	return w
+}
+
+func (w *symlinkWatcher) ignored(relPath string) bool {
+	return w.ignores.Match(relPath).IsIgnored()
+}
+
+// relativePaths maps a path within the targets back to the folder. It is nil if symlinks are not followed.
+func (w *symlinkWatcher) relativePaths(path string) []string {
+	if w == nil {
+		return nil
 	}
-	// will we ever get out of this loop?
-	for {
-		evAbsolutePath := waitForEvent(c)
-		Debug.Println("Change detected in: " + evAbsolutePath + " (could still be ignored)")
-		evRelPath := relativePath(evAbsolutePath, folderPath)
-		if ignores.Match(evRelPath).IsIgnored() {
-			Debug.Println("Ignoring", evAbsolutePath)
+	return w.targets.relativePaths(path)
+}
+
+// changed updates the watches after path, relPath in the folder, changed. Symlinks which no
+// longer lead to their target are dropped and a new symlink at path is followed.
+func (w *symlinkWatcher) changed(path string, relPath string) {
+	w.drop(relPath)
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		w.add(followSymlink(path, relPath, w.folderPath, w.targets, w.ignored))
+	}
+}
+
+// add watches the targets of the symlinks in links, which are not watched yet
+func (w *symlinkWatcher) add(links symlinkTargets) {
+	for _, t := range links {
+		if _, ok := w.stops[t.target]; !ok && !w.watch(t) {
+			continue
+		}
+		w.targets = append(w.targets, t)
+		w.registerIgnores(t.target)
+		OK.Println("Watching " + w.folder.Label + ": " + t.relPath + " -> " + t.target)
+	}
+}
+
+// watch installs the watch of the target of t. Returns false if it failed.
+func (w *symlinkWatcher) watch(t symlinkTarget) bool {
+	tc := make(chan notify.EventInfo, maxFiles)
+	if err := notify.Watch(filepath.Join(t.target, "..."), tc, watchEvents()...); err != nil {
+		Warning.Println("Failed to watch "+t.target+" for "+t.relPath+" in "+w.folder.Label+".", err)
+		return false
+	}
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case ev := <-tc:
+				select {
+				case w.c <- ev:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	w.stops[t.target] = func() {
+		notify.Stop(tc)
+		close(stop)
+	}
+	return true
+}
+
+// drop stops following the symlinks at or below relPath which no longer lead to their target
+func (w *symlinkWatcher) drop(relPath string) {
+	var kept symlinkTargets
+	changed := make(map[string]bool)
+	for _, t := range w.targets {
+		if _, ok := trimFolder(t.relPath, relPath); ok || len(relPath) == 0 {
+			if target, err := realPath(filepath.Join(w.folderPath, t.relPath)); err != nil || target != t.target {
+				OK.Println("Stopped watching " + w.folder.Label + ": " + t.relPath + " -> " + t.target)
+				changed[t.target] = true
+				continue
+			}
+		}
+		kept = append(kept, t)
+	}
+	w.targets = kept
+	for target := range changed {
+		if len(w.targets.to(target)) > 0 {
+			w.registerIgnores(target)
 			continue
 		}
-		Trace.Println("Change detected in: " + evAbsolutePath)
-		fsInput <- evRelPath
+		w.stops[target]()
+		delete(w.stops, target)
+		unregisterIgnores(target)
+	}
+}
+
+// registerIgnores registers the ignore test of target, which is ignored if it is ignored for every symlink leading to it
+func (w *symlinkWatcher) registerIgnores(target string) {
+	links := w.targets.to(target)
+	registerIgnores(target, func(absolutePath string) bool {
+		for _, relPath := range links.relativePaths(absolutePath) {
+			if !w.ignores.Match(relPath).IsIgnored() {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// stop stops the watches of all targets. It is nil if symlinks are not followed.
+func (w *symlinkWatcher) stop() {
+	if w == nil {
+		return
+	}
+	for target, stop := range w.stops {
+		stop()
+		unregisterIgnores(target)
+	}
+	w.targets, w.stops = nil, nil
+}
+
+// watchEvents returns the events to watch for
+func watchEvents() []notify.Event {
+	events := []notify.Event{notify.All}
+	if writeTimeout > 0 {
+		events = append(events, writeEvents...)
+	}
+	return events
+}
+
+// debounceTimeoutFor returns the accumulation interval for folder depending on its type.
+// Local changes in receive-only folders are not sent to other devices, so they are less urgent.
+func debounceTimeoutFor(folder FolderConfiguration) time.Duration {
+	switch folder.Type {
+	case "receiveonly", "receiveencrypted":
+		if receiveOnlyTimeout > debounceTimeout {
+			return receiveOnlyTimeout
+		}
 	}
+	return debounceTimeout
 }
 
 func realPath(path string) (string, error) {
@@ -457,63 +925,130 @@ func realPath(path string) (string, error) {
 	return filepath.EvalSymlinks(path)
 }
 
-func relativePath(path string, folderPath string) string {
-	path = expandTilde(path);
-	path = strings.TrimPrefix(path, folderPath)
-	if len(path) == 0 {
+// pathKeyFor returns a function which maps paths to the form in which Syncthing compares them,
+// NFC if it normalizes names and lower case if the filesystem is case insensitive
+func pathKeyFor(normalize bool, caseInsensitive bool) func(string) string {
+	return func(path string) string {
+		if normalize {
+			path = norm.NFC.String(path)
+		}
+		if caseInsensitive {
+			path = strings.ToLower(path)
+		}
 		return path
 	}
-	if os.IsPathSeparator(path[0]) {
-		path = path[1:len(path)]
+}
+
+// caseInsensitiveFS reports whether the filesystem of folderPath treats names which only differ in
+// case as the same. The folder or one of its first entries is looked up with the case of its name
+// swapped; without a name to swap the filesystem is assumed to be case sensitive.
+func caseInsensitiveFS(folderPath string) bool {
+	paths := []string{folderPath}
+	if fd, err := os.Open(folderPath); err == nil {
+		names, _ := fd.Readdirnames(64)
+		fd.Close()
+		for _, name := range names {
+			paths = append(paths, filepath.Join(folderPath, name))
+		}
+	}
+	for _, path := range paths {
+		dir, name := filepath.Split(path)
+		swapped := swapCase(name)
+		if swapped == name {
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			continue
+		}
+		swappedInfo, err := os.Lstat(filepath.Join(dir, swapped))
+		return err == nil && os.SameFile(info, swappedInfo)
+	}
+	return false
+}
+
+// swapCase turns upper case letters of s into lower case letters and vice versa
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, s)
+}
+
+// relativePath returns path relative to folderPath, "" for the folder itself. Relative paths and
+// paths outside of folderPath are returned as they are. Paths are not expanded, a file named ~ is
+// not the home directory.
+func relativePath(path string, folderPath string) string {
+	if relPath, ok := trimFolder(path, folderPath); ok {
+		return relPath
 	}
 	return path
 }
 
-// waitForEvent waits for an event in a channel c and returns event.Path().
-// When channel c is closed then it returns path for default event (not sure if this is used at all?)
-func waitForEvent(c chan notify.EventInfo) string {
-	select {
-	case ev, ok := <-c:
-		if !ok {
-			// this is never reached b/c c is never closed
-			Warning.Println("Error: channel closed")
+// trimFolder removes folderPath from path if path is folderPath or located below it. Unlike a
+// string prefix, /data/a does not contain /data/ab.
+func trimFolder(path string, folderPath string) (string, bool) {
+	root := strings.TrimRight(folderPath, pathSeparator)
+	if path == root || path == folderPath {
+		return "", true
+	}
+	root += pathSeparator // The root directory is trimmed to "" above
+	if !strings.HasPrefix(path, root) {
+		return "", false
+	}
+	return path[len(root):], true
+}
+
+// folderRelativePath returns the path of an event relative to folderPath, which has to be a real
+// path (see realPath). Paths reported via a symlinked route to the folder are resolved. ok is false
+// for paths outside of the folder.
+func folderRelativePath(path string, folderPath string) (relPath string, ok bool) {
+	if relPath, ok := trimFolder(path, folderPath); ok {
+		return relPath, true
+	}
+	// The parent directory is resolved, as the path itself may have been deleted or be a symlink
+	dir, err := realPath(filepath.Dir(path))
+	if err != nil {
+		return "", false
+	}
+	if relDir, ok := trimFolder(dir, folderPath); ok {
+		if relDir == "" {
+			return filepath.Base(path), true
 		}
-		return ev.Path()
+		return relDir + pathSeparator + filepath.Base(path), true
 	}
+	if real, err := realPath(path); err == nil && real == strings.TrimRight(folderPath, pathSeparator) {
+		// A symlink to the folder itself
+		return "", true
+	}
+	return "", false
 }
 
-func prepareApiRequestForSyncthing(request *http.Request) (*http.Request, error) {
+func (st *stInstance) prepareApiRequestForSyncthing(request *http.Request) (*http.Request, error) {
 	if request == nil {
 		return nil, errors.New("Invalid HTTP Request object")
 	}
-	if len(csrfToken) > 0 {
-		request.Header.Set("X-CSRF-Token", csrfToken)
+	if len(st.csrfToken) > 0 {
+		request.Header.Set("X-CSRF-Token", st.csrfToken)
 	}
-	if len(authUser) > 0 {
-		request.SetBasicAuth(authUser, authPass)
+	if len(st.authUser) > 0 {
+		request.SetBasicAuth(st.authUser, st.authPass)
 	}
-	if len(apiKey) > 0 {
-		request.Header.Set("X-API-Key", apiKey)
+	if len(st.apiKey) > 0 {
+		request.Header.Set("X-API-Key", st.apiKey)
 	}
 	return request, nil
 }
 
 // performRequest performs an HTTP request r to Synthing API
-func performRequest(r *http.Request) (*http.Response, error) {
-	request, err := prepareApiRequestForSyncthing(r)
+func (st *stInstance) performRequest(r *http.Request) (*http.Response, error) {
+	request, err := st.prepareApiRequestForSyncthing(r)
 	if request == nil {
 		return nil, err
 	}
-	tr := &http.Transport{
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
-		ResponseHeaderTimeout: requestTimeout,
-		DisableKeepAlives:     true,
-	}
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   requestTimeout,
-	}
-	res, err := client.Do(request)
+	res, err := st.client.Do(request)
 	if res != nil && res.StatusCode == 403 {
 		Warning.Printf("Error: HTTP POST forbidden. Missing API key?")
 		return res, errors.New("HTTP POST forbidden")
@@ -522,29 +1057,29 @@ func performRequest(r *http.Request) (*http.Response, error) {
 }
 
 // testWebGuiPost tries to connect to Syncthing returning nil on success
-func testWebGuiPost() error {
-	Trace.Println("Testing WebGUI")
-	r, err := http.NewRequest("GET", target+"/rest/404", nil)
-	res, err := performRequest(r)
+func (st *stInstance) testWebGuiPost() error {
+	Trace.Println("Testing WebGUI of " + st.String())
+	r, err := http.NewRequest("GET", st.target+"/rest/404", nil)
+	res, err := st.performRequest(r)
 	defer closeRequestResult(res)
 	if err != nil {
-		Warning.Println("Cannot connect to Syncthing:", err)
+		Warning.Println("Cannot connect to "+st.String()+":", err)
 		return err
 	}
 	body, _ := ioutil.ReadAll(res.Body)
 	if res.StatusCode != 404 {
-		Warning.Printf("Cannot connect to Syncthing, Status %d != 404 for GET. Body: %v\n", res.StatusCode, string(body))
+		Warning.Printf("Cannot connect to "+st.String()+", Status %d != 404 for GET. Body: %v\n", res.StatusCode, string(body))
 		return errors.New("Invalid HTTP status code")
 	}
 	return nil
 }
 
 // informError sends a msg error to Syncthing
-func informError(msg string) error {
+func (st *stInstance) informError(msg string) error {
 	Trace.Printf("Informing ST about inotify error: %v", msg)
-	r, _ := http.NewRequest("POST", target+"/rest/system/error", strings.NewReader("[Inotify] "+msg))
+	r, _ := http.NewRequest("POST", st.target+"/rest/system/error", strings.NewReader("[Inotify] "+msg))
 	r.Header.Set("Content-Type", "plain/text")
-	res, err := performRequest(r)
+	res, err := st.performRequest(r)
 	defer closeRequestResult(res)
 	if err != nil {
 		Warning.Println("Failed to inform Syncthing about", msg, err)
@@ -557,8 +1092,8 @@ func informError(msg string) error {
 	return err
 }
 
-// informChange sends a request to rescan folder and subs to Syncthing
-func informChange(folder string, subs []string) error {
+// scanURL returns the path and query of the request to rescan folder and subs
+func scanURL(folder string, subs []string) string {
 	data := url.Values{}
 	data.Set("folder", folder)
 	for _, sub := range subs {
@@ -567,9 +1102,33 @@ func informChange(folder string, subs []string) error {
 	if delayScan > 0 {
 		data.Set("next", strconv.Itoa(delayScan))
 	}
+	return "/rest/db/scan?" + data.Encode()
+}
+
+// splitScan splits subs into chunks whose scan request URLs are at most maxScanURLLength long.
+// Syncthing only accepts subs in the query. A single sub which is too long gets a chunk of its own.
+func splitScan(folder string, subs []string) [][]string {
+	var chunks [][]string
+	var chunk []string
+	length := len(scanURL(folder, nil))
+	for _, sub := range subs {
+		// Length of "&sub=" and the escaped sub
+		subLength := len(scanURL(folder, []string{sub})) - len(scanURL(folder, nil))
+		if len(chunk) > 0 && length+subLength > maxScanURLLength {
+			chunks = append(chunks, chunk)
+			chunk, length = nil, len(scanURL(folder, nil))
+		}
+		chunk = append(chunk, sub)
+		length += subLength
+	}
+	return append(chunks, chunk)
+}
+
+// informChange sends a request to rescan folder and subs to Syncthing
+func (st *stInstance) informChange(folder string, subs []string) error {
 	Trace.Printf("Informing ST: %v: %v", folder, subs)
-	r, _ := http.NewRequest("POST", target+"/rest/db/scan?"+data.Encode(), nil)
-	res, err := performRequest(r)
+	r, _ := http.NewRequest("POST", st.target+scanURL(folder, subs), nil)
+	res, err := st.performRequest(r)
 	defer closeRequestResult(res)
 	if err != nil {
 		Warning.Println("Failed to perform request", err)
@@ -577,7 +1136,7 @@ func informChange(folder string, subs []string) error {
 	}
 	if res.StatusCode != 200 {
 		msg, _ := ioutil.ReadAll(res.Body)
-		Warning.Println(target + "/rest/db/scan?" + data.Encode())
+		Warning.Println(st.target + scanURL(folder, subs))
 		Warning.Printf("Error: Status %d != 200 for POST: %v, %s\n", res.StatusCode, folder, msg)
 		return errors.New("Invalid HTTP status code")
 	}
@@ -603,166 +1162,709 @@ func askToDelayScan(folder string, callback InformCallback) {
 // - no redundant folder searches (abc + abc/d is useless)
 // - no excessive large scans (abc/{1..1000} should become a scan of just abc folder)
 // One of the difficulties is that we cannot know if deleted files were a directory or a file.
+// It returns once done is closed and the scan requests in flight finished.
 func accumulateChanges(debounceTimeout time.Duration,
 	folder string,
 	folderPath string,
 	dirVsFiles int,
 	stInput chan STEvent,
-	fsInput chan string,
-	callback InformCallback) func(string) {
-	var delayScanInterval time.Duration
-	if delayScan > 0 {
-		delayScanInterval = time.Duration(delayScan-5) * time.Second
-		Debug.Printf("Delay scan reminder interval for %s set to %.0f seconds\n", folder, delayScanInterval.Seconds())
-	} else {
-		// If delayScan is set to 0, then we never send requests to delay full scans.
-		// "9999 * time.Hour" here is an approximation of "forever".
-		delayScanInterval = 9999 * time.Hour
-		Debug.Println("Delay scan reminders are disabled")
-	}
-	inProgress := make(map[string]progressTime) // [path string]{fs, start}
-	currInterval := delayScanInterval           // Timeout of the timer
-	if delayScan > 0 {
-		askToDelayScan(folder, callback)
-	}
-	nextScanTime := time.Now().Add(delayScanInterval) // Time to remind Syncthing to delay scan
+	fsInput chan FSEvent,
+	resume chan resumeState,
+	callback InformCallback,
+	pathKey func(string) string,
+	done <-chan struct{}) func(string) {
+	a := newChangeAccumulator(realClock{}, debounceTimeout, folder, folderPath, dirVsFiles, callback)
+	if pathKey != nil {
+		a.pathKey = pathKey
+	}
+	// Scans run in the background, such that changes keep being collected while Syncthing is scanning
+	scanResults := make(chan scanResult)
+	requests := 0 // Scan requests in flight
+	a.startScan = func(id int, subs []string) {
+		requests++
+		go func() {
+			scanResults <- scanResult{id, callback(folder, subs)}
+		}()
+	}
+	checkpointTicker := time.NewTicker(checkpointInterval)
+	defer checkpointTicker.Stop()
 	flushTimer := time.NewTimer(0)
-	flushTimerNeedsReset := true
 	for {
-		if flushTimerNeedsReset {
-			flushTimerNeedsReset = false
-			flushTimer.Reset(currInterval)
+		if a.flushTimerNeedsReset {
+			a.flushTimerNeedsReset = false
+			flushTimer.Reset(a.flushInterval())
 		}
 		select {
 		case item := <-stInput:
-			if item.Path == "" {
-				// Prepare for incoming changes
-				if currInterval != debounceTimeout {
-					currInterval = debounceTimeout
-					flushTimerNeedsReset = true
+			a.stEvent(item)
+		case item := <-fsInput:
+			a.fsEvent(item.Path)
+			if item.Writing || item.Closed {
+				a.fsWrite(item.Path, item.Closed)
+			}
+		case res := <-scanResults:
+			requests--
+			a.scanFinished(res.id, res.err)
+		case r := <-resume:
+			// Checkpoints would lose changes before resuming
+			resume = nil
+			for _, path := range r.paths {
+				if path == "" {
+					a.requestFullScan()
+				} else {
+					a.fsEvent(path)
 				}
-				Debug.Println("[ST] Incoming Changes for " + folder + ", speeding up inotify timeout parameters")
-				continue
 			}
-			if item.Finished {
-				// Ensure path is cleared when receiving itemFinished
-				delete(inProgress, item.Path)
-				Debug.Println("[ST] Removed tracking for " + item.Path)
-				continue
+			a.saveState = r.save
+			a.stateDirty = true
+		case <-checkpointTicker.C:
+			if a.stateDirty {
+				a.checkpoint(a.clock.Now())
 			}
-			if len(inProgress) > maxFiles {
-				Debug.Println("[ST] Tracking too many files, aggregating STEvent: " + item.Path)
-				continue
+		case <-flushTimer.C:
+			a.flush()
+		case <-done:
+			// Requests in flight still inform about changes of this accumulator
+			for ; requests > 0; requests-- {
+				<-scanResults
 			}
-			Debug.Println("[ST] Incoming: " + item.Path)
-			inProgress[item.Path] = progressTime{false, time.Now()}
-		case item := <-fsInput:
-			if currInterval != debounceTimeout {
-				currInterval = debounceTimeout
-				flushTimerNeedsReset = true
+			// Changes which were not informed about yet are picked up by the next watcher
+			if a.stateDirty {
+				a.checkpoint(a.clock.Now())
 			}
-			Debug.Println("[FS] Incoming Changes for " + folder + ", speeding up inotify timeout parameters")
-			p, ok := inProgress[item]
-			if ok && !p.fsEvent {
-				// Change originated from ST
-				delete(inProgress, item)
-				Debug.Println("[FS] Removed tracking for " + item)
-				continue
+			return nil
+		}
+	}
+}
+
+// scanResult is the outcome of the scan request with the given id
+type scanResult struct {
+	id  int
+	err error
+}
+
+// pendingScan is a scan request which Syncthing did not finish yet
+type pendingScan struct {
+	id            int
+	subs          []string
+	paths         []string   // Tracked paths covered by the scan, unless full
+	full          bool       // The scan covers all tracked paths
+	overflow      []string   // Directories summarizing untracked changes covered by the scan
+	chunks        [][]string // Subs to request once Syncthing finished scanning subs (see splitScan)
+	done          []string   // Subs of chunks which Syncthing already scanned
+	time          time.Time  // Changes after this time are not covered by the scan
+	started       bool       // Syncthing changed the folder state to scanning after the request
+	requestFailed bool       // The request failed after Syncthing started scanning
+	failedAt      time.Time  // Time the request failed
+}
+
+// changeAccumulator holds the state of accumulateChanges for a single folder.
+// accumulateChanges feeds it from channels and a timer; a replay drives it with a virtual clock.
+type changeAccumulator struct {
+	clock              clock
+	debounceTimeout    time.Duration // Accumulation interval for isolated changes
+	maxDebounceTimeout time.Duration // Accumulation interval after changes kept coming in for this long
+	delayScanInterval  time.Duration
+	folder             string
+	folderPath         string
+	dirVsFiles         int
+	callback           InformCallback
+	pathStatus         statPathFunc
+	pathKey            func(string) string // Form of paths of Syncthing events, see pathKeyFor
+	dirSize            dirSizeFunc         // Optional
+	// State
+	inProgress           map[string]progressTime // [path string]{fs, start}
+	currInterval         time.Duration           // Timeout of the timer
+	nextScanTime         time.Time               // Time to remind Syncthing to delay scan
+	flushTimerNeedsReset bool                    // flushInterval has to be (re)applied to the timer
+	retryBackOff         *backoff.ExponentialBackOff
+	retryTime            time.Time                   // Do not inform Syncthing before this time after a failed scan request
+	scan                 *pendingScan                // Scan request in progress
+	scanID               int                         // ID of the latest scan request
+	startScan            func(id int, subs []string) // Requests a scan, its result is passed to scanFinished
+	saveState            func(state folderState)     // Checkpoints the state, optional
+	stateDirty           bool                        // Changes were tracked since the last checkpoint
+	lastScan             time.Time                   // Time of the last successful scan
+	fullScan             bool                        // The entire folder has to be scanned
+	paused               bool                        // The folder is paused in Syncthing
+	burstStart           time.Time                   // Time of the first change since the folder was quiet
+	lastChange           time.Time                   // Time of the latest change
+	activeInterval       time.Duration               // Timeout of the timer while changes are tracked
+	openForWrite         map[string]time.Time        // Tracked paths which are being written, by the time of the first write
+	overflow             map[string]progressTime     // Changes beyond maxFiles, summarized by their path up to overflowDepth components
+	overflowDepth        int                         // Number of path components kept in overflow
+}
+
+func newChangeAccumulator(clock clock,
+	debounceTimeout time.Duration,
+	folder string,
+	folderPath string,
+	dirVsFiles int,
+	callback InformCallback) *changeAccumulator {
+	var delayScanInterval time.Duration
+	if delayScan > 0 {
+		delayScanInterval = time.Duration(delayScan-5) * time.Second
+		Debug.Printf("Delay scan reminder interval for %s set to %.0f seconds\n", folder, delayScanInterval.Seconds())
+	} else {
+		// If delayScan is set to 0, then we never send requests to delay full scans.
+		// "9999 * time.Hour" here is an approximation of "forever".
+		delayScanInterval = 9999 * time.Hour
+		Debug.Println("Delay scan reminders are disabled")
+	}
+	// Folders with a longer interval (receive-only) are never accumulated for a shorter time
+	maxDebounce := maxDebounceTimeout
+	if maxDebounce < debounceTimeout {
+		maxDebounce = debounceTimeout
+	}
+	a := &changeAccumulator{
+		clock:                clock,
+		debounceTimeout:      debounceTimeout,
+		maxDebounceTimeout:   maxDebounce,
+		delayScanInterval:    delayScanInterval,
+		folder:               folder,
+		folderPath:           folderPath,
+		dirVsFiles:           dirVsFiles,
+		callback:             callback,
+		pathStatus:           folderPathStatus(folderPath),
+		pathKey:              pathKeyFor(false, false),
+		dirSize:              newDirSizeCache(clock, folderPath).size,
+		inProgress:           make(map[string]progressTime),
+		openForWrite:         make(map[string]time.Time),
+		overflow:             make(map[string]progressTime),
+		currInterval:         delayScanInterval,
+		activeInterval:       debounceTimeout,
+		flushTimerNeedsReset: true,
+		retryBackOff:         backoff.NewExponentialBackOff(),
+	}
+	// Failed scan requests are retried until they succeed
+	a.retryBackOff.InitialInterval = configSyncTimeout
+	a.retryBackOff.MaxInterval = 60 * configSyncTimeout
+	a.retryBackOff.MaxElapsedTime = 0
+	a.retryBackOff.Clock = clock
+	a.retryBackOff.Reset()
+	// By default scans are synchronous
+	a.startScan = func(id int, subs []string) {
+		a.scanFinished(id, a.callback(a.folder, subs))
+	}
+	if delayScan > 0 {
+		askToDelayScan(folder, callback)
+	}
+	a.nextScanTime = clock.Now().Add(delayScanInterval)
+	return a
+}
+
+// stEvent processes an event coming from Syncthing
+func (a *changeAccumulator) stEvent(item STEvent) {
+	if item.Paused {
+		// Requests for paused folders fail. Syncthing scans the folder when it is resumed.
+		Debug.Println("[ST] " + a.folder + " paused, dropping all changes")
+		a.paused = true
+		a.inProgress = make(map[string]progressTime)
+		a.openForWrite = make(map[string]time.Time)
+		a.overflow = make(map[string]progressTime)
+		a.fullScan = false
+		a.scan = nil
+		a.retryBackOff.Reset()
+		a.retryTime = time.Time{}
+		a.stateDirty = true
+		return
+	}
+	if item.Resumed {
+		Debug.Println("[ST] " + a.folder + " resumed")
+		a.paused = false
+		return
+	}
+	if item.Restarted {
+		if a.scan != nil {
+			// The end of the scan will not be reported, changes stay tracked and are informed about again
+			Debug.Println("[ST] Syncthing restarted, dropping the pending scan of " + a.folder)
+			a.scan = nil
+			a.flushTimerNeedsReset = true
+		}
+		return
+	}
+	if item.Overflow {
+		// Events of Syncthing were lost, so changes made by Syncthing can no longer be told apart
+		// from local changes. Stop ignoring any change and assume more remote changes are coming.
+		for path, progress := range a.inProgress {
+			if !progress.fsEvent {
+				delete(a.inProgress, path)
 			}
-			if len(inProgress) > maxFiles {
-				Debug.Println("[FS] Tracking too many files, aggregating FSEvent: " + item)
+		}
+		Debug.Println("[ST] Lost events for " + a.folder + ", scanning all changes")
+		if a.scan != nil && a.scan.requestFailed {
+			// The end of the scan might have been lost as well
+			a.completeScan(nil)
+		}
+		item.Path = ""
+	}
+	if len(item.State) > 0 {
+		a.stateChanged(item.State, item.Time)
+		return
+	}
+	if item.Path == "" {
+		// Prepare for incoming changes
+		a.speedUp()
+		Debug.Println("[ST] Incoming Changes for " + a.folder + ", speeding up inotify timeout parameters")
+		return
+	}
+	// Changes of Syncthing are tracked by their key, such that the filesystem events they cause match
+	key := a.pathKey(item.Path)
+	if item.Finished {
+		// Ensure path is cleared when receiving itemFinished
+		delete(a.inProgress, item.Path)
+		delete(a.inProgress, key)
+		Debug.Println("[ST] Removed tracking for " + item.Path)
+		return
+	}
+	if len(a.inProgress) > maxFiles {
+		Debug.Println("[ST] Tracking too many files, aggregating STEvent: " + item.Path)
+		return
+	}
+	Debug.Println("[ST] Incoming: " + item.Path)
+	a.inProgress[key] = progressTime{false, a.clock.Now(), a.clock.Now()}
+}
+
+// fsEvent processes a change of the path item observed on the filesystem
+func (a *changeAccumulator) fsEvent(item string) {
+	if a.paused {
+		return
+	}
+	a.changeSeen()
+	Debug.Println("[FS] Incoming Changes for " + a.folder + ", speeding up inotify timeout parameters")
+	if key := a.pathKey(item); key != item {
+		if p, ok := a.inProgress[key]; ok && !p.fsEvent {
+			// Change originated from ST, which reported the path in another form
+			delete(a.inProgress, key)
+			Debug.Println("[FS] Removed tracking for " + item)
+			return
+		}
+	}
+	p, ok := a.inProgress[item]
+	if ok && !p.fsEvent {
+		// Change originated from ST
+		delete(a.inProgress, item)
+		Debug.Println("[FS] Removed tracking for " + item)
+		return
+	}
+	if !ok && len(a.inProgress) > maxFiles {
+		a.trackOverflow(item)
+		return
+	}
+	Debug.Println("[FS] Tracking: " + item)
+	first := a.clock.Now()
+	if ok {
+		first = p.first
+	}
+	a.inProgress[item] = progressTime{true, a.clock.Now(), first}
+	a.stateDirty = true
+}
+
+// overflowDepth is the number of path components kept for changes beyond maxFiles at first
+const overflowDepth = 3
+
+// trackOverflow keeps track of a change beyond maxFiles by the path of item cut to overflowDepth
+// components, e.g. a/b/c for a/b/c/d/file. If more than maxFiles of these change, they are cut
+// by one more component until the changes are spread over the entire folder and it is scanned.
+func (a *changeAccumulator) trackOverflow(item string) {
+	if a.fullScan {
+		return
+	}
+	if len(a.overflow) == 0 {
+		a.overflowDepth = overflowDepth
+	}
+	key := cutPath(item, a.folderPath, a.overflowDepth)
+	Debug.Println("[FS] Tracking too many files, aggregating FSEvent " + item + " into " + key)
+	a.overflow[key] = mergeProgress(a.overflow[key], progressTime{true, a.clock.Now(), a.clock.Now()})
+	a.stateDirty = true
+	for len(a.overflow) > maxFiles {
+		a.overflowDepth--
+		if a.overflowDepth == 0 {
+			Debug.Println("[FS] Changes are spread over all of " + a.folder)
+			a.overflow = make(map[string]progressTime)
+			a.requestFullScan()
+			return
+		}
+		cut := make(map[string]progressTime)
+		for path, progress := range a.overflow {
+			key := cutPath(path, a.folderPath, a.overflowDepth)
+			cut[key] = mergeProgress(cut[key], progress)
+		}
+		a.overflow = cut
+	}
+}
+
+// mergeProgress combines the changes of two paths, either of which may be unset
+func mergeProgress(p progressTime, q progressTime) progressTime {
+	if p.time.IsZero() {
+		return q
+	}
+	if q.time.After(p.time) {
+		p.time = q.time
+	}
+	if q.first.Before(p.first) {
+		p.first = q.first
+	}
+	return p
+}
+
+// cutPath returns path with at most depth components below folderPath, e.g. a/b for a/b/c/d at depth 2
+func cutPath(path string, folderPath string, depth int) string {
+	relPath := relativePath(path, folderPath)
+	components := strings.SplitN(relPath, pathSeparator, depth+1)
+	if len(components) <= depth {
+		return path
+	}
+	return path[:len(path)-len(relPath)] + strings.Join(components[:depth], pathSeparator)
+}
+
+// fsWrite processes a write to the path item, or the close of item by a writer. Changes of
+// tracked paths are held until their writer closed them (see due).
+func (a *changeAccumulator) fsWrite(item string, closed bool) {
+	if closed {
+		if _, ok := a.openForWrite[item]; ok {
+			Debug.Println("[FS] Closed by writer: " + item)
+			delete(a.openForWrite, item)
+		}
+		return
+	}
+	if p, ok := a.inProgress[item]; !ok || !p.fsEvent {
+		return
+	}
+	if _, ok := a.openForWrite[item]; !ok {
+		Debug.Println("[FS] Open for writing: " + item)
+		a.openForWrite[item] = a.clock.Now()
+	}
+}
+
+// requestFullScan makes the next scan request cover the entire folder
+func (a *changeAccumulator) requestFullScan() {
+	Debug.Println("Full scan of " + a.folder + " requested")
+	a.fullScan = true
+	a.stateDirty = true
+	a.speedUp()
+}
+
+// changeSeen adapts the accumulation interval to the rate of changes. Changes which come in
+// within the interval of the previous change extend a burst, and the interval grows with the
+// duration of the burst up to maxDebounceTimeout. Isolated changes use debounceTimeout.
+func (a *changeAccumulator) changeSeen() {
+	now := a.clock.Now()
+	if a.lastChange.IsZero() || now.Sub(a.lastChange) > a.activeInterval {
+		a.burstStart = now
+	}
+	a.lastChange = now
+	interval := now.Sub(a.burstStart)
+	if interval < a.debounceTimeout {
+		interval = a.debounceTimeout
+	} else if interval > a.maxDebounceTimeout {
+		interval = a.maxDebounceTimeout
+	}
+	if interval != a.activeInterval {
+		Debug.Printf("Accumulation interval for %s set to %v", a.folder, interval)
+		a.activeInterval = interval
+	}
+	a.speedUp()
+}
+
+// speedUp switches the timer to the accumulation interval
+func (a *changeAccumulator) speedUp() {
+	if a.currInterval != a.activeInterval {
+		a.currInterval = a.activeInterval
+		a.flushTimerNeedsReset = true
+	}
+}
+
+// flushInterval returns the time until the next flush, which is postponed while waiting to retry a failed scan request
+func (a *changeAccumulator) flushInterval() time.Duration {
+	if wait := a.retryTime.Sub(a.clock.Now()); wait > a.currInterval {
+		return wait
+	}
+	return a.currInterval
+}
+
+// flush informs Syncthing about the changes which did not change for currInterval
+func (a *changeAccumulator) flush() {
+	a.flushTimerNeedsReset = true
+	if a.paused {
+		a.currInterval = a.delayScanInterval
+		return
+	}
+	if delayScan > 0 && a.scan == nil && !a.nextScanTime.After(a.clock.Now()) {
+		a.nextScanTime = a.clock.Now().Add(a.delayScanInterval)
+		askToDelayScan(a.folder, a.callback)
+	}
+	if len(a.inProgress) == 0 && !a.fullScan {
+		if a.currInterval != a.delayScanInterval {
+			Debug.Println("Slowing down inotify timeout parameters for " + a.folder)
+			a.currInterval = a.delayScanInterval
+		}
+		return
+	}
+	if a.scan != nil && a.scan.requestFailed && a.clock.Now().Sub(a.scan.failedAt) >= scanEndTimeout {
+		a.completeScan(errors.New("Syncthing did not report the end of the scan within " + scanEndTimeout.String()))
+	}
+	if a.scan != nil {
+		// Changes are collected and informed about once Syncthing finished the current scan
+		Debug.Println("Waiting for Syncthing to finish scanning " + a.folder)
+		return
+	}
+	if a.clock.Now().Before(a.retryTime) {
+		// Changes of a failed scan request stay tracked and are merged with new changes at the next attempt
+		Debug.Println("Waiting to retry informing about changes in " + a.folder)
+		return
+	}
+	Debug.Println("Timeout AccumulateChanges")
+	var paths []string
+	expiry := a.clock.Now().Add(-a.maxDebounceTimeout * 10)
+	if !a.fullScan {
+		for path, progress := range a.inProgress {
+			// Clean up invalid and expired paths
+			if path == "" || (!progress.fsEvent && progress.time.Before(expiry)) {
+				delete(a.inProgress, path)
 				continue
 			}
-			Debug.Println("[FS] Tracking: " + item)
-			inProgress[item] = progressTime{true, time.Now()}
-		case <-flushTimer.C:
-			flushTimerNeedsReset = true
-			if delayScan > 0 && nextScanTime.Before(time.Now()) {
-				nextScanTime = time.Now().Add(delayScanInterval)
-				askToDelayScan(folder, callback)
+			if progress.fsEvent && a.due(path, progress) {
+				paths = append(paths, path)
+				Debug.Println("Informing about " + path)
+			} else {
+				Debug.Println("Waiting for " + path)
 			}
-			if len(inProgress) == 0 {
-				if currInterval != delayScanInterval {
-					Debug.Println("Slowing down inotify timeout parameters for " + folder)
-					currInterval = delayScanInterval
-				}
-				continue
+		}
+		var overflow []string
+		for path, progress := range a.overflow {
+			if a.due(path, progress) {
+				overflow = append(overflow, path)
+				Debug.Println("Informing about all of " + path)
 			}
-			Debug.Println("Timeout AccumulateChanges")
-			var err error
-			var paths []string
-			expiry := time.Now().Add(-debounceTimeout * 10)
-			if len(inProgress) < maxFiles {
-				for path, progress := range inProgress {
-					// Clean up invalid and expired paths
-					if path == "" || (!progress.fsEvent && progress.time.Before(expiry)) {
-						delete(inProgress, path)
-						continue
-					}
-					if progress.fsEvent && time.Now().Sub(progress.time) > currInterval {
-						paths = append(paths, path)
-						Debug.Println("Informing about " + path)
-					} else {
-						Debug.Println("Waiting for " + path)
-					}
-				}
-				if len(paths) == 0 {
-					Debug.Println("Empty paths")
-					continue
-				}
+		}
+		if len(paths) == 0 && len(overflow) == 0 {
+			Debug.Println("Empty paths")
+			return
+		}
+		// Directories in overflow are changed directories for aggregateChanges, which are scanned as a whole
+		subs := aggregateChanges(a.folderPath, a.dirVsFiles, append(append([]string(nil), paths...), overflow...), a.pathStatus, a.dirSize)
+		a.inform(subs, paths, overflow, false)
+	} else {
+		// Do not track more than maxFiles changes, inform syncthing to rescan entire folder
+		a.inform([]string{""}, nil, nil, true)
+	}
+}
 
-				// Try to inform changes to syncthing and if succeeded, clean up
-				err = callback(folder, aggregateChanges(folderPath, dirVsFiles, paths, currentPathStatus))
-				if err == nil {
-					for _, path := range paths {
-						delete(inProgress, path)
-						Debug.Println("[INFORMED] Removed tracking for " + path)
-					}
-				}
-			} else {
-				// Do not track more than maxFiles changes, inform syncthing to rescan entire folder
-				err = callback(folder, []string{""})
-				if err == nil {
-					for path, progress := range inProgress {
-						if progress.fsEvent {
-							delete(inProgress, path)
-							Debug.Println("[INFORMED] Removed tracking for " + path)
-						}
-					}
-				}
-			}
+// due reports whether the change of path has to be informed about now. Paths are informed
+// about once they did not change for currInterval or at the latest after maxWait, but not
+// while they are open for writing (up to writeTimeout). Hot paths are informed about every
+// hotInterval while they are changing.
+func (a *changeAccumulator) due(path string, progress progressTime) bool {
+	now := a.clock.Now()
+	if isHotPath(relativePath(path, a.folderPath)) {
+		return now.Sub(progress.first) >= hotInterval
+	}
+	if since, ok := a.openForWrite[path]; ok {
+		if now.Sub(since) < writeTimeout {
+			return false
+		}
+		Debug.Println(path + " is still open for writing, informing after " + writeTimeout.String())
+		delete(a.openForWrite, path)
+	}
+	if now.Sub(progress.time) > a.currInterval {
+		return true
+	}
+	if maxWait > 0 && now.Sub(progress.first) >= maxWait {
+		Debug.Println(path + " keeps changing, informing after " + maxWait.String())
+		return true
+	}
+	return false
+}
 
-			if err == nil {
-				nextScanTime = time.Now().Add(delayScanInterval) // Scan was delayed
-			} else {
-				Warning.Println("Syncthing failed to index changes for ", folder, err)
-				time.Sleep(configSyncTimeout)
-			}
+// isHotPath reports whether relPath matches hotPaths. Patterns without a separator match the file name.
+func isHotPath(relPath string) bool {
+	for _, pattern := range hotPaths {
+		name := relPath
+		if !strings.Contains(pattern, pathSeparator) {
+			name = filepath.Base(relPath)
+		}
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
 		}
 	}
+	return false
 }
 
-func cleanPaths(paths []string) {
-	for i := range paths {
-		paths[i] = filepath.Clean(paths[i])
+// inform requests Syncthing to scan subs, which cover the tracked paths and overflow directories, or all tracked paths if full
+func (a *changeAccumulator) inform(subs []string, paths []string, overflow []string, full bool) {
+	chunks := splitScan(a.folder, subs)
+	if len(chunks) > 1 {
+		Debug.Printf("Informing about %d paths in %s in %d requests", len(subs), a.folder, len(chunks))
 	}
+	a.scanID++
+	a.scan = &pendingScan{id: a.scanID, subs: chunks[0], paths: paths, overflow: overflow, full: full, time: a.clock.Now(),
+		chunks: chunks[1:]}
+	a.startScan(a.scan.id, a.scan.subs)
 }
 
-func sortedUniqueAndCleanPaths(paths []string) []string {
-	cleanPaths(paths)
-	sort.Strings(paths)
-	var new_paths []string
-	previousPath := ""
+// nextChunk requests the next chunk of the pending scan, given that the current chunk succeeded
+func (a *changeAccumulator) nextChunk() {
+	scan := a.scan
+	a.scanID++
+	scan.id = a.scanID
+	scan.done = append(scan.done, scan.subs...)
+	scan.subs, scan.chunks = scan.chunks[0], scan.chunks[1:]
+	scan.started, scan.requestFailed = false, false
+	a.startScan(scan.id, scan.subs)
+}
+
+// scanFinished processes the result of the scan request with the given id
+func (a *changeAccumulator) scanFinished(id int, err error) {
+	if a.scan == nil || a.scan.id != id {
+		// Syncthing already reported the end of the scan
+		return
+	}
+	if err != nil && a.scan.started {
+		// Syncthing is scanning regardless, wait until it reports the end of the scan
+		Debug.Println("Scan request for "+a.folder+" failed while Syncthing is scanning:", err)
+		a.scan.requestFailed = true
+		a.scan.failedAt = a.clock.Now()
+		return
+	}
+	a.completeScan(err)
+}
+
+// stateChanged processes a change of the state of the folder in Syncthing at the given time
+func (a *changeAccumulator) stateChanged(state string, at time.Time) {
+	Debug.Println("[ST] State of " + a.folder + " changed to " + state)
+	if a.scan == nil {
+		return
+	}
+	if !at.IsZero() && at.Before(a.scan.time) {
+		// Queued from a scan before the request, like the one asking to delay scans
+		Debug.Println("[ST] Ignoring state change of " + a.folder + " before the scan was requested")
+		return
+	}
+	if state == "scanning" {
+		a.scan.started = true
+	} else if a.scan.started {
+		a.completeScan(nil)
+	}
+}
+
+// completeScan cleans up after the pending scan succeeded or schedules a retry if it failed
+func (a *changeAccumulator) completeScan(err error) {
+	if err == nil && len(a.scan.chunks) > 0 {
+		a.nextChunk()
+		return
+	}
+	scan := a.scan
+	a.scan = nil
+	a.flushTimerNeedsReset = true
+	if err != nil {
+		wait := a.retryBackOff.NextBackOff()
+		a.retryTime = a.clock.Now().Add(wait)
+		Warning.Println("Syncthing failed to index changes for ", a.folder, err, "retrying in", wait)
+		if len(scan.done) > 0 {
+			// Only changes which are not covered by the chunks scanned so far are retried
+			removeInformed(a.inProgress, coveredPaths(scan.paths, scan.done, a.folderPath), scan.time)
+			removeInformed(a.overflow, coveredPaths(scan.overflow, scan.done, a.folderPath), scan.time)
+			a.stateDirty = true
+		}
+		return
+	}
+	a.nextScanTime = a.clock.Now().Add(a.delayScanInterval) // Scan was delayed
+	a.retryBackOff.Reset()
+	a.retryTime = time.Time{}
+	// Paths which changed again since the scan was requested are kept for the next scan
+	covered, overflow := scan.paths, scan.overflow
+	if scan.full {
+		a.fullScan = false
+		for path := range a.inProgress {
+			covered = append(covered, path)
+		}
+		for path := range a.overflow {
+			overflow = append(overflow, path)
+		}
+	}
+	removeInformed(a.inProgress, covered, scan.time)
+	removeInformed(a.overflow, overflow, scan.time)
+	a.lastScan = a.clock.Now()
+	a.checkpoint(scan.time)
+}
+
+// coveredPaths returns the paths which are covered by a scan of subs
+func coveredPaths(paths []string, subs []string, folderPath string) []string {
+	var covered []string
+	for _, path := range paths {
+		relPath := relativePath(path, folderPath)
+		for _, sub := range subs {
+			if sub == "" || relPath == sub || strings.HasPrefix(relPath, sub+pathSeparator) {
+				covered = append(covered, path)
+				break
+			}
+		}
+	}
+	return covered
+}
+
+// removeInformed stops tracking paths of tracked which did not change since a scan covering them was requested at scanTime
+func removeInformed(tracked map[string]progressTime, paths []string, scanTime time.Time) {
 	for _, path := range paths {
-		if path == "." {
-			path = ""
+		progress, ok := tracked[path]
+		if !ok || !progress.fsEvent {
+			continue
 		}
-		if path != previousPath {
-			new_paths = append(new_paths, path)
+		if progress.time.After(scanTime) {
+			// Changes before the request were covered
+			if progress.first.Before(scanTime) {
+				progress.first = scanTime
+				tracked[path] = progress
+			}
+			continue
+		}
+		delete(tracked, path)
+		Debug.Println("[INFORMED] Removed tracking for " + path)
+	}
+}
+
+// checkpoint saves the pending changes, given that all changes before the time until were informed about
+func (a *changeAccumulator) checkpoint(until time.Time) {
+	if a.saveState == nil {
+		return
+	}
+	a.stateDirty = false
+	state := folderState{LastInformed: a.informedUntil(until), LastScan: a.lastScan}
+	if a.fullScan {
+		state.Pending = []string{""}
+	} else {
+		for path, progress := range a.inProgress {
+			if progress.fsEvent {
+				state.Pending = append(state.Pending, path)
+			}
+		}
+		// Directories in overflow are resumed like changed directories, which are scanned as a whole
+		for path := range a.overflow {
+			state.Pending = append(state.Pending, path)
+		}
+		sort.Strings(state.Pending)
+	}
+	a.saveState(state)
+}
+
+// informedUntil returns the time before which all changes were informed about or are tracked,
+// given that all changes before the time until were informed about
+func (a *changeAccumulator) informedUntil(until time.Time) time.Time {
+	for _, tracked := range []map[string]progressTime{a.inProgress, a.overflow} {
+		for _, progress := range tracked {
+			if progress.fsEvent && progress.first.Before(until) {
+				until = progress.first
+			}
 		}
-		previousPath = path
 	}
-	return new_paths
+	return until
+}
+
+func cleanPaths(paths []string) {
+	for i := range paths {
+		paths[i] = filepath.Clean(paths[i])
+	}
 }
 
 type PathStatus int
@@ -785,91 +1887,199 @@ func currentPathStatus(path string) PathStatus {
 
 type statPathFunc func(name string) PathStatus
 
+// folderPathStatus returns the status of paths, which are resolved against folderPath if they are relative
+func folderPathStatus(folderPath string) statPathFunc {
+	return func(path string) PathStatus {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(folderPath, path)
+		}
+		return currentPathStatus(path)
+	}
+}
+
 // AggregateChanges optimises tracking in two ways:
 // - If there are more than `dirVsFiles` changes in a directory, we inform Syncthing to scan the entire directory
 // - Directories with parent directory changes are aggregated. If A/B has 3 changes and A/C has 8, A will have 11 changes and if this is bigger than dirVsFiles we will scan A.
-func aggregateChanges(folderPath string, dirVsFiles int, paths []string, pathStatus statPathFunc) []string {
-	// Map paths to scores; if score == -1 the path is a filename
-	trackedPaths := make(map[string]int)
-	// Map of directories
-	trackedDirs := make(map[string]bool)
-	// Make sure parent paths are processed first
-	paths = sortedUniqueAndCleanPaths(paths)
-	// First we collect all paths and calculate scores for them
+// Unless dirSize is nil, directories which are too large compared to their changes (see subScanCost) are not scanned as a whole.
+func aggregateChanges(folderPath string, dirVsFiles int, paths []string, pathStatus statPathFunc, dirSize dirSizeFunc) []string {
+	return explainAggregation(folderPath, dirVsFiles, paths, pathStatus, dirSize, nil)
+}
+
+// aggregationDecision describes what aggregateChanges decided for a single tracked path and why
+type aggregationDecision struct {
+	Path   string
+	Status PathStatus
+	Score  int // -1 for files
+	Scan   bool
+	Reason string
+}
+
+type explainFunc func(decision aggregationDecision)
+
+// pathNode is a path in the tree of changes built by explainAggregation
+type pathNode struct {
+	children map[string]*pathNode
+	status   PathStatus
+	changed  bool // The path itself changed
+	tracked  bool // The path gets a decision: it changed or is the parent directory of a changed file
+	dir      bool // Later changes below the path count for it: it changed as a directory or contains a changed file
+	changes  int  // Number of changes which count for the path
+}
+
+func (n *pathNode) child(name string) *pathNode {
+	if n.children == nil {
+		n.children = make(map[string]*pathNode)
+	}
+	c, ok := n.children[name]
+	if !ok {
+		c = &pathNode{status: directoryPath}
+		n.children[name] = c
+	}
+	return c
+}
+
+// score is -1 for files. Directories score the changes which count for them, changed
+// directories and deleted paths start at dirVsFiles as they have to be scanned anyway.
+func (n *pathNode) score(dirVsFiles int) int {
+	if n.changed && n.status == filePath {
+		return -1
+	}
+	if n.changed {
+		return dirVsFiles + n.changes
+	}
+	return n.changes
+}
+
+// explainAggregation performs aggregateChanges and reports every decision to explain (if not nil)
+func explainAggregation(folderPath string, dirVsFiles int, paths []string, pathStatus statPathFunc, dirSize dirSizeFunc, explain explainFunc) []string {
+	// Build a tree of all changed paths, relative to the folder. Parents are processed first and
+	// a change counts for the directories above it which are already tracked at that point.
+	root := &pathNode{status: directoryPath}
+	cleanPaths(paths)
+	sort.Strings(paths)
+	var above []*pathNode // Nodes above the current path, from the root down
 	for _, path := range paths {
-		pathstatus := pathStatus(path)
-		path = strings.TrimPrefix(path, folderPath)
-		path = strings.TrimPrefix(path, pathSeparator)
-		var dir string
-		if pathstatus == deletedPath {
-			// Definitely inform if the path does not exist anymore
-			dir = path
-			trackedPaths[path] = dirVsFiles
-			Debug.Println("[AG] Not found:", path)
-		} else if pathstatus == directoryPath {
-			// Definitely inform if a directory changed
-			dir = path
-			trackedPaths[path] = dirVsFiles
-			trackedDirs[dir] = true
-			Debug.Println("[AG] Is a dir:", dir)
-		} else {
-			Debug.Println("[AG] Is file:", path)
-			// Files are linked to -1 scores
-			// Also increment the parent path with 1
-			dir = filepath.Dir(path)
-			if dir == "." {
-				dir = ""
+		relPath := relativePath(path, folderPath)
+		if relPath == "." {
+			relPath = ""
+		}
+		n := root
+		above = above[:0]
+		if len(relPath) > 0 {
+			for _, name := range strings.Split(relPath, pathSeparator) {
+				above = append(above, n)
+				n = n.child(name)
 			}
-			trackedPaths[path] = -1
-			trackedPaths[dir]++
-			trackedDirs[dir] = true
-		}
-		// Search for existing parent directory relations in the map
-		for trackedPath := range trackedPaths {
-			if trackedDirs[trackedPath] && strings.HasPrefix(dir, trackedPath+pathSeparator) {
-				// Increment score of tracked parent directory for each file
-				trackedPaths[trackedPath]++
-				Debug.Println("[AG] Increment:", trackedPath, trackedPaths, trackedPaths[trackedPath])
+		}
+		if n.changed {
+			continue
+		}
+		n.changed = true
+		n.tracked = true
+		n.status = pathStatus(path)
+		switch {
+		case n.status == filePath && n != root:
+			// Files are scanned as part of their directory if it has enough changes
+			parent := above[len(above)-1]
+			parent.tracked = true
+			parent.dir = true
+			parent.changes++
+			above = above[:len(above)-1]
+		case n.status == directoryPath:
+			n.dir = true
+		}
+		// Changes only count for the folder itself if they are located directly in it
+		for _, a := range above {
+			if a.dir && a != root {
+				a.changes++
 			}
 		}
 	}
-	var keys []string
-	for k := range trackedPaths {
-		keys = append(keys, k)
+	if len(paths) == 0 {
+		return nil
 	}
-	sort.Strings(keys) // Sort directories before their own files
-	previousPath := ""
+
 	var scans []string
-	// Decide if we should inform about particular path based on dirVsFiles
-	for i := range keys {
-		trackedPath := keys[i]
-		trackedPathScore := trackedPaths[trackedPath]
-		if strings.HasPrefix(trackedPath, previousPath+pathSeparator) {
-			// Already informed parent directory change
-			continue
+	// Decide for every tracked path, parents before their children, whether it is scanned based on dirVsFiles
+	var decide func(path string, n *pathNode, coveredBy *string) bool
+	decide = func(path string, n *pathNode, coveredBy *string) bool {
+		if n.tracked {
+			score := n.score(dirVsFiles)
+			decision := aggregationDecision{Path: path, Status: n.status, Score: score}
+			switch {
+			case coveredBy != nil:
+				// Already informed parent directory change
+				if *coveredBy == "" {
+					decision.Reason = "covered by scan of the entire folder"
+				} else {
+					decision.Reason = "covered by scan of " + *coveredBy
+				}
+			case score < dirVsFiles && score != -1:
+				// Not enough files for this directory or it is a file
+				decision.Reason = fmt.Sprintf("score %d < %d, changes are scanned individually", score, dirVsFiles)
+			case dirSize != nil && score != -1 && n.status == directoryPath && !n.changed &&
+				dirSize(path, score*subScanCost+1) > score*subScanCost:
+				// Scanning a huge directory costs more than scanning its changes individually
+				Debug.Println("[AG] Too large to be scanned as a whole:", path)
+				decision.Reason = fmt.Sprintf("score %d >= %d, but more than %d paths in it, changes are scanned individually",
+					score, dirVsFiles, score*subScanCost)
+			default:
+				Debug.Println("[AG] Appending path:", path)
+				scans = append(scans, path)
+				decision.Scan = true
+				switch {
+				case score == -1:
+					decision.Reason = "changed file"
+				case n.status == deletedPath:
+					decision.Reason = "deleted path"
+				default:
+					decision.Reason = fmt.Sprintf("score %d >= %d", score, dirVsFiles)
+				}
+				coveredBy = &path
+			}
+			if explain != nil {
+				explain(decision)
+			} else if coveredBy != nil {
+				// Nothing left to decide below a scanned path
+				return path == ""
+			}
 		}
-		if trackedPathScore < dirVsFiles && trackedPathScore != -1 {
-			// Not enough files for this directory or it is a file
-			continue
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			names = append(names, name)
 		}
-		previousPath = trackedPath
-		Debug.Println("[AG] Appending path:", trackedPath, previousPath)
-		scans = append(scans, trackedPath)
-		if trackedPath == "" {
-			// If we need to scan everything, skip the rest
-			break
+		sort.Strings(names)
+		for _, name := range names {
+			childPath := name
+			if len(path) > 0 {
+				childPath = path + pathSeparator + name
+			}
+			if decide(childPath, n.children[name], coveredBy) {
+				return true
+			}
 		}
+		return false
 	}
+	decide("", root, nil)
 	return scans
 }
 
 // watchSTEvents reads events from Syncthing. For events of type ItemStarted and ItemFinished it puts
-// them into aproppriate stChans, where key is a folder from event.
-// For ConfigSaved event it spawns goroutine waitForSyncAndExitIfNeeded.
-func watchSTEvents(stChans map[string]chan STEvent, folders []FolderConfiguration) {
-	lastSeenID := 0
+// them into aproppriate stChans, where key is a folder from event. Events are queued per folder,
+// such that a busy folder does not hold up polling for events.
+// For ConfigSaved event it notifies configSaved without blocking. Returns once done is closed.
+func (st *stInstance) watchSTEvents(stChans map[string]chan STEvent, configSaved chan<- struct{}, done <-chan struct{}) {
+	dispatcher := newSTDispatcher(st, stChans, done)
+	go dispatcher.reportStats(time.Minute)
+	lastSeenID := st.resumeEventID()
+	checkpointer := eventCheckpointer{st: st}
 	for {
-		events, err := getSTEvents(lastSeenID)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		events, err := st.getSTEvents(lastSeenID)
 		if err != nil {
 			// Work-around for Go <1.5 (https://github.com/golang/go/issues/9405)
 			if strings.Contains(err.Error(), "use of closed network connection") {
@@ -878,8 +2088,14 @@ func watchSTEvents(stChans map[string]chan STEvent, folders []FolderConfiguratio
 
 			// Syncthing probably restarted
 			Debug.Println("Resetting STEvents", err)
+			if lastSeenID != 0 {
+				dispatcher.dispatchAll(STEvent{Restarted: true})
+			}
 			lastSeenID = 0
-			time.Sleep(configSyncTimeout)
+			select {
+			case <-time.After(configSyncTimeout):
+			case <-done:
+			}
 			continue
 		}
 		if events == nil {
@@ -889,39 +2105,67 @@ func watchSTEvents(stChans map[string]chan STEvent, folders []FolderConfiguratio
 			switch event.Type {
 			case "RemoteIndexUpdated":
 				data := event.Data.(map[string]interface{})
-				ch, ok := stChans[data["folder"].(string)]
-				if !ok {
-					continue
-				}
-				ch <- STEvent{Path: "", Finished: false}
+				dispatcher.dispatch(data["folder"].(string), STEvent{Path: "", Finished: false})
 			case "ItemStarted":
 				data := event.Data.(map[string]interface{})
-				ch, ok := stChans[data["folder"].(string)]
-				if !ok {
-					continue
-				}
-				ch <- STEvent{Path: data["item"].(string), Finished: false}
+				dispatcher.dispatch(data["folder"].(string), STEvent{Path: data["item"].(string), Finished: false})
 			case "ItemFinished":
 				data := event.Data.(map[string]interface{})
-				ch, ok := stChans[data["folder"].(string)]
-				if !ok {
-					continue
-				}
-				ch <- STEvent{Path: data["item"].(string), Finished: true}
+				dispatcher.dispatch(data["folder"].(string), STEvent{Path: data["item"].(string), Finished: true})
+			case "StateChanged":
+				data := event.Data.(map[string]interface{})
+				dispatcher.dispatch(data["folder"].(string), STEvent{State: data["to"].(string), Time: event.Time})
+			case "FolderPaused":
+				data := event.Data.(map[string]interface{})
+				dispatcher.dispatch(data["id"].(string), STEvent{Paused: true})
+			case "FolderResumed":
+				data := event.Data.(map[string]interface{})
+				dispatcher.dispatch(data["id"].(string), STEvent{Resumed: true})
+			case "FolderScanProgress":
+				data := event.Data.(map[string]interface{})
+				Debug.Printf("Syncthing is scanning %v: %v of %v bytes", data["folder"], data["current"], data["total"])
 			case "ConfigSaved":
-				Trace.Println("ConfigSaved, exiting if folders changed")
-				go waitForSyncAndExitIfNeeded(folders)
+				Trace.Println("ConfigSaved, watching folders again if they changed")
+				select {
+				case configSaved <- struct{}{}:
+				default:
+				}
 			}
 		}
 		lastSeenID = events[len(events)-1].ID
+		checkpointer.seen(lastSeenID)
+	}
+}
+
+// getLatestEventID returns the ID of the latest Syncthing event
+func (st *stInstance) getLatestEventID() (int, error) {
+	Trace.Println("Requesting latest STEvent")
+	r, err := http.NewRequest("GET", st.target+"/rest/events?"+st.eventsQuery("since=0&limit=1"), nil)
+	res, err := st.performRequest(r)
+	defer closeRequestResult(res)
+	if err != nil {
+		Warning.Println("Failed to perform request", err)
+		return 0, err
 	}
+	if res.StatusCode != 200 {
+		Warning.Printf("Status %d != 200 for GET", res.StatusCode)
+		return 0, errors.New("Invalid HTTP status code")
+	}
+	var events []Event
+	if err := json.NewDecoder(res.Body).Decode(&events); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+	return events[len(events)-1].ID, nil
 }
 
 // getSTEvents returns a list of events which happened in Syncthing since lastSeenID.
-func getSTEvents(lastSeenID int) ([]Event, error) {
+func (st *stInstance) getSTEvents(lastSeenID int) ([]Event, error) {
 	Trace.Println("Requesting STEvents: " + strconv.Itoa(lastSeenID))
-	r, err := http.NewRequest("GET", target+"/rest/events?since="+strconv.Itoa(lastSeenID), nil)
-	res, err := performRequest(r)
+	r, err := http.NewRequest("GET", st.target+"/rest/events?"+st.eventsQuery("since="+strconv.Itoa(lastSeenID)), nil)
+	res, err := st.performRequest(r)
 	defer closeRequestResult(res)
 	if err != nil {
 		Warning.Println("Failed to perform request", err)
@@ -940,15 +2184,35 @@ func getSTEvents(lastSeenID int) ([]Event, error) {
 	return events, err
 }
 
-// waitForSyncAndExitIfNeeded performs restart of itself if folders has different configuration in syncthing.
-func waitForSyncAndExitIfNeeded(folders []FolderConfiguration) {
-	waitForSync()
-	newFolders := getFolders()
+// waitForFolderChange returns the folders of st once Syncthing saved its configuration and
+// they have a different configuration than folders
+func (st *stInstance) waitForFolderChange(folders []FolderConfiguration, configSaved <-chan struct{}) []FolderConfiguration {
+	for {
+		<-configSaved
+		st.waitForSync()
+		var newFolders []FolderConfiguration
+		err := backoff.Retry(func() (err error) {
+			newFolders, err = st.getFolders()
+			return err
+		}, backoff.NewExponentialBackOff())
+		if err != nil {
+			Warning.Println("Failed to get folders of "+st.String()+":", err)
+			continue
+		}
+		if foldersChanged(folders, newFolders) {
+			return newFolders
+		}
+	}
+}
+
+// foldersChanged reports whether newFolders differ from folders in a way that requires watching them again
+func foldersChanged(folders []FolderConfiguration, newFolders []FolderConfiguration) bool {
 	same := len(folders) == len(newFolders)
 	for _, newF := range newFolders {
 		seen := false
 		for _, f := range folders {
-			if f.ID == newF.ID && f.Path == newF.Path {
+			if f.ID == newF.ID && f.Path == newF.Path && f.FSWatcherEnabled == newF.FSWatcherEnabled && f.Type == newF.Type &&
+				f.AutoNormalize == newF.AutoNormalize && f.CaseSensitiveFS == newF.CaseSensitiveFS {
 				seen = true
 			}
 		}
@@ -957,23 +2221,15 @@ func waitForSyncAndExitIfNeeded(folders []FolderConfiguration) {
 			same = false
 		}
 	}
-	if !same {
-		// Simply exit as folders:
-		// - can be added (still ok)
-		// - can be removed as well (requires informing tons of goroutines...)
-		OK.Println("Syncthing folder configuration updated, restarting")
-		if !restart() {
-			log.Fatalln("Cannot restart syncthing-inotify, exiting")
-		}
-	}
+	return !same
 }
 
 // waitForSync blocks execution until syncthing is in sync
-func waitForSync() {
+func (st *stInstance) waitForSync() {
 	for {
 		Trace.Println("Waiting for Sync")
-		r, err := http.NewRequest("GET", target+"/rest/system/config/insync", nil)
-		res, err := performRequest(r)
+		r, err := http.NewRequest("GET", st.target+"/rest/system/config/insync", nil)
+		res, err := st.performRequest(r)
 		defer closeRequestResult(res)
 		if err != nil {
 			Warning.Println("Failed to perform request /rest/system/config/insync", err)
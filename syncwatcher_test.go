@@ -2,8 +2,13 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -12,7 +17,7 @@ import (
 
 var (
 	slash         = string(os.PathSeparator)
-	testDirectory = filepath.Join(os.Getenv("TMPDIR"), "test") + slash
+	testDirectory = filepath.Join(os.TempDir(), "test") + slash
 )
 
 func clearTestDir() {
@@ -53,6 +58,262 @@ func createTestPath(t *testing.T, f string) string {
 	return f
 }
 
+func fsEvent(path string) recordedEvent {
+	return recordedEvent{Kind: "fs", Path: path}
+}
+
+func stEvent(path string, finished bool) recordedEvent {
+	return recordedEvent{Kind: "st", Path: path, Finished: finished}
+}
+
+// accumulate feeds events into a changeAccumulator for testDirectory which is driven by a virtual clock.
+// It returns as soon as all changes have been informed about.
+func accumulate(debounceTimeout time.Duration, repo string, dirVsFiles int, events []recordedEvent, callback InformCallback) {
+	clock := &virtualClock{now: time.Now()}
+	a := newChangeAccumulator(clock, debounceTimeout, repo, testDirectory, dirVsFiles, callback)
+	runAccumulator(a, clock, events, time.Time{})
+}
+
+func TestAccumulateChanges(t *testing.T) {
+	// Changes are informed about by the real timer loop
+	testRepo := "test1"
+	testFile := createTestPath(t, "file1")
+	defer clearTestDir()
+	stChan := make(chan STEvent)
+	fsChan := make(chan FSEvent)
+	informed := make(chan []string, 10)
+	fileChange := func(repo string, sub []string) error {
+		if len(sub) == 1 && sub[0] == ".stfolder" {
+			return nil
+		}
+		informed <- sub
+		return nil
+	}
+	defer runUntilStopped(func(done <-chan struct{}) {
+		accumulateChanges(10*time.Millisecond, testRepo, testDirectory, 10, stChan, fsChan, nil, fileChange, nil, done)
+	})()
+	fsChan <- FSEvent{Path: testFile}
+	select {
+	case sub := <-informed:
+		if len(sub) != 1 || sub[0] != testFile {
+			t.Errorf("Invalid result for file change: %#v", sub)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("Callback not triggered")
+	}
+}
+
+func TestDelayScanReminders(t *testing.T) {
+	defer func(d int) { delayScan = d }(delayScan)
+	delayScan = 60
+	testRepo := "test1"
+	testFile := createTestPath(t, "file1")
+	defer clearTestDir()
+	start := time.Now()
+	clock := &virtualClock{now: start}
+	var reminders []time.Duration
+	var changes []time.Duration
+	fileChange := func(repo string, sub []string) error {
+		if len(sub) == 1 && sub[0] == ".stfolder" {
+			reminders = append(reminders, clock.Now().Sub(start))
+		} else {
+			changes = append(changes, clock.Now().Sub(start))
+		}
+		return nil
+	}
+	a := newChangeAccumulator(clock, time.Second, testRepo, testDirectory, 10, fileChange)
+	events := []recordedEvent{fsEvent(testFile)}
+	events[0].Time = start.Add(100 * time.Second)
+	runAccumulator(a, clock, events, start.Add(200*time.Second))
+	// Reminded at start and after being idle for 55 seconds, a scan of changes delays the next full scan as well
+	expectedReminders := []time.Duration{0, 55 * time.Second, 158 * time.Second}
+	expectedChanges := []time.Duration{102 * time.Second}
+	if fmt.Sprint(reminders) != fmt.Sprint(expectedReminders) {
+		t.Errorf("Expected reminders at %v, got %v", expectedReminders, reminders)
+	}
+	if fmt.Sprint(changes) != fmt.Sprint(expectedChanges) {
+		t.Errorf("Expected changes at %v, got %v", expectedChanges, changes)
+	}
+}
+
+func TestFailedScanRetries(t *testing.T) {
+	// Failed scans are retried with exponential backoff and merged with new changes
+	defer func(d time.Duration) { configSyncTimeout = d }(configSyncTimeout)
+	configSyncTimeout = time.Second
+	testRepo := "test1"
+	testFiles := createTestPaths(t, "file1", "file2")
+	defer clearTestDir()
+	start := time.Now()
+	clock := &virtualClock{now: start}
+	var attempts []time.Duration
+	var informed [][]string
+	fileChange := func(repo string, sub []string) error {
+		if len(sub) == 1 && sub[0] == ".stfolder" {
+			return nil
+		}
+		attempts = append(attempts, clock.Now().Sub(start))
+		if len(attempts) <= 3 {
+			return errors.New("Syncthing is busy")
+		}
+		informed = append(informed, sub)
+		return nil
+	}
+	a := newChangeAccumulator(clock, 100*time.Millisecond, testRepo, testDirectory, 10, fileChange)
+	a.retryBackOff.RandomizationFactor = 0
+	events := []recordedEvent{fsEvent(testFiles[0]), fsEvent(testDirectory + testFiles[1])}
+	events[1].Time = start.Add(2 * time.Second)
+	runAccumulator(a, clock, events, time.Time{})
+	// The first attempt fails after 200ms, then retries follow after 1s, 1.5s and 2.25s
+	expectedAttempts := []time.Duration{200 * time.Millisecond, 1200 * time.Millisecond, 2700 * time.Millisecond, 4950 * time.Millisecond}
+	if fmt.Sprint(attempts) != fmt.Sprint(expectedAttempts) {
+		t.Errorf("Expected attempts at %v, got %v", expectedAttempts, attempts)
+	}
+	if len(informed) != 1 || !slicesEqual(informed[0], testFiles) {
+		t.Errorf("Expected a single scan of %v, got %v", testFiles, informed)
+	}
+}
+
+func TestAsynchronousScans(t *testing.T) {
+	// Changes are collected while Syncthing scans and are informed about once it reports the end of the scan
+	testRepo := "test1"
+	testFiles := createTestPaths(t, "file1", "file2")
+	defer clearTestDir()
+	clock := &virtualClock{now: time.Now()}
+	var requests [][]string
+	fileChange := func(repo string, sub []string) error {
+		return nil
+	}
+	a := newChangeAccumulator(clock, 100*time.Millisecond, testRepo, testDirectory, 10, fileChange)
+	a.startScan = func(id int, subs []string) {
+		requests = append(requests, subs)
+	}
+	a.fsEvent(testFiles[0])
+	clock.now = clock.now.Add(200 * time.Millisecond)
+	a.flush()
+	if len(requests) != 1 || !slicesEqual(requests[0], testFiles[:1]) || a.scan == nil {
+		t.Fatalf("Expected a scan of %v, got %v", testFiles[:1], requests)
+	}
+	// Changes during the scan
+	clock.now = clock.now.Add(50 * time.Millisecond)
+	a.fsEvent(testFiles[0])
+	a.fsEvent(testFiles[1])
+	clock.now = clock.now.Add(200 * time.Millisecond)
+	a.flush()
+	// A scan which was already running when the request was made is not the requested scan
+	a.stEvent(STEvent{State: "idle"})
+	a.flush()
+	if len(requests) != 1 {
+		t.Fatalf("Scan requested while Syncthing is scanning: %v", requests)
+	}
+	a.stEvent(STEvent{State: "scanning"})
+	a.stEvent(STEvent{State: "idle"})
+	if a.scan != nil {
+		t.Fatal("Scan not completed after Syncthing finished scanning")
+	}
+	// The request returns after the end of the scan was reported
+	a.scanFinished(1, nil)
+	a.flush()
+	if len(requests) != 2 || !slicesEqual(requests[1], testFiles) {
+		t.Fatalf("Expected a scan of %v, got %v", testFiles, requests)
+	}
+	// A request failing while Syncthing is scanning is not retried
+	a.stEvent(STEvent{State: "scanning"})
+	a.scanFinished(2, errors.New("Timeout"))
+	a.stEvent(STEvent{State: "idle"})
+	if a.scan != nil || len(a.inProgress) != 0 || !a.retryTime.IsZero() {
+		t.Errorf("Scan not completed: %#v, %v", a.scan, a.inProgress)
+	}
+}
+
+func TestLostScanEnd(t *testing.T) {
+	// Scans whose end Syncthing will not report do not hold up further scans
+	testRepo := "test1"
+	testFiles := createTestPaths(t, "file1")
+	defer clearTestDir()
+	clock := &virtualClock{now: time.Now()}
+	var requests [][]string
+	fileChange := func(repo string, sub []string) error {
+		return nil
+	}
+	a := newChangeAccumulator(clock, 100*time.Millisecond, testRepo, testDirectory, 10, fileChange)
+	a.retryBackOff.RandomizationFactor = 0
+	a.startScan = func(id int, subs []string) {
+		requests = append(requests, subs)
+	}
+	a.fsEvent(testFiles[0])
+	clock.now = clock.now.Add(200 * time.Millisecond)
+	a.flush()
+	// The request fails while Syncthing is scanning, but the end of the scan is never reported
+	a.stEvent(STEvent{State: "scanning"})
+	a.scanFinished(1, errors.New("Timeout"))
+	clock.now = clock.now.Add(scanEndTimeout - time.Second)
+	a.flush()
+	if len(requests) != 1 || a.scan == nil {
+		t.Fatalf("Scan given up before %v: %v", scanEndTimeout, requests)
+	}
+	clock.now = clock.now.Add(time.Second)
+	a.flush()
+	if a.scan != nil || a.retryTime.IsZero() {
+		t.Fatalf("Scan not given up after %v: %#v", scanEndTimeout, a.scan)
+	}
+	clock.now = a.retryTime
+	a.flush()
+	if len(requests) != 2 || !slicesEqual(requests[1], testFiles) {
+		t.Fatalf("Expected a retry of %v, got %v", testFiles, requests)
+	}
+	// Syncthing restarted while scanning
+	a.stEvent(STEvent{State: "scanning"})
+	a.stEvent(STEvent{Restarted: true})
+	if a.scan != nil {
+		t.Fatal("Scan not dropped after Syncthing restarted")
+	}
+	a.flush()
+	if len(requests) != 3 || !slicesEqual(requests[2], testFiles) {
+		t.Errorf("Expected another scan of %v, got %v", testFiles, requests)
+	}
+}
+
+func TestStateChangedBeforeRequest(t *testing.T) {
+	// State changes queued from scans before the request, like the one asking to delay scans, do not complete it
+	testRepo := "test1"
+	testFiles := createTestPaths(t, "file1")
+	defer clearTestDir()
+	clock := &virtualClock{now: time.Now()}
+	var requests [][]string
+	fileChange := func(repo string, sub []string) error {
+		return nil
+	}
+	a := newChangeAccumulator(clock, 100*time.Millisecond, testRepo, testDirectory, 10, fileChange)
+	a.retryBackOff.RandomizationFactor = 0
+	a.startScan = func(id int, subs []string) {
+		requests = append(requests, subs)
+	}
+	a.fsEvent(testFiles[0])
+	clock.now = clock.now.Add(200 * time.Millisecond)
+	before := clock.now.Add(-time.Millisecond)
+	a.flush()
+	a.stEvent(STEvent{State: "scanning", Time: before})
+	a.stEvent(STEvent{State: "idle", Time: before})
+	if a.scan == nil {
+		t.Fatal("Scan completed by state changes before the request")
+	}
+	// The failed request is retried
+	a.scanFinished(1, errors.New("Timeout"))
+	if a.scan != nil || a.retryTime.IsZero() || len(a.inProgress) != 1 {
+		t.Fatalf("Failed scan not retried: %#v, %v", a.scan, a.inProgress)
+	}
+	clock.now = a.retryTime
+	a.flush()
+	if len(requests) != 2 || !slicesEqual(requests[1], testFiles) {
+		t.Fatalf("Expected a retry of %v, got %v", testFiles, requests)
+	}
+	a.stEvent(STEvent{State: "scanning", Time: clock.now})
+	a.stEvent(STEvent{State: "idle", Time: clock.now})
+	if a.scan != nil || len(a.inProgress) != 0 {
+		t.Errorf("Scan not completed: %#v, %v", a.scan, a.inProgress)
+	}
+}
+
 func TestDebouncedFileWatch(t *testing.T) {
 	// Log file change
 	testOK := false
@@ -63,8 +324,7 @@ func TestDebouncedFileWatch(t *testing.T) {
 	defer clearTestDir()
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := 10
-	stChan := make(chan STEvent, 10)
-	fsChan := make(chan string, 10)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
@@ -76,10 +336,9 @@ func TestDebouncedFileWatch(t *testing.T) {
 		return nil
 	}
 	for i := range testFiles {
-		fsChan <- testDirectory + testFiles[i]
+		events = append(events, fsEvent(testFiles[i]))
 	}
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	time.Sleep(testDebounceTimeout * 50)
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if !testOK {
 		t.Error("Callback not triggered")
 	}
@@ -92,8 +351,7 @@ func TestDebouncedDirectoryWatch(t *testing.T) {
 	testFile := createTestPath(t, "a"+slash)
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := 10
-	stChan := make(chan STEvent, 10)
-	fsChan := make(chan string, 10)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
@@ -104,9 +362,8 @@ func TestDebouncedDirectoryWatch(t *testing.T) {
 		testOK = true
 		return nil
 	}
-	fsChan <- testDirectory + testFile
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	time.Sleep(testDebounceTimeout * 50)
+	events = append(events, fsEvent(testFile))
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if !testOK {
 		t.Error("Callback not triggered")
 	}
@@ -124,8 +381,7 @@ func TestDebouncedParentDirectoryWatch(t *testing.T) {
 	defer clearTestDir()
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := 2
-	stChan := make(chan STEvent, 10)
-	fsChan := make(chan string, 10)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
@@ -137,10 +393,9 @@ func TestDebouncedParentDirectoryWatch(t *testing.T) {
 		return nil
 	}
 	for i := range testFiles {
-		fsChan <- testDirectory + testFiles[i]
+		events = append(events, fsEvent(testFiles[i]))
 	}
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	time.Sleep(testDebounceTimeout * 50)
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if !testOK {
 		t.Error("Callback not triggered")
 	}
@@ -161,8 +416,7 @@ func TestDebouncedParentDirectoryWatch2(t *testing.T) {
 	defer clearTestDir()
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := 10
-	stChan := make(chan STEvent, 10)
-	fsChan := make(chan string, 10)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
@@ -177,10 +431,9 @@ func TestDebouncedParentDirectoryWatch2(t *testing.T) {
 		return nil
 	}
 	for i := range testFiles {
-		fsChan <- testDirectory + testFiles[i]
+		events = append(events, fsEvent(testFiles[i]))
 	}
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	time.Sleep(testDebounceTimeout * 50)
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if testOK != 2 {
 		t.Error("Callback not correctly triggered")
 	}
@@ -197,25 +450,23 @@ func TestDebouncedParentDirectoryWatch3(t *testing.T) {
 	defer clearTestDir()
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := 3
-	stChan := make(chan STEvent, 10)
-	fsChan := make(chan string, 10)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
 		}
 		for i, s := range sub {
 			if repo != testRepo || s != testFiles[i] {
-				t.Errorf("Invalid result for directory change %t : (%v) %#v", testOK, repo, s)
+				t.Errorf("Invalid result for directory change %d : (%v) %#v", testOK, repo, s)
 			}
 		}
 		testOK = len(sub)
 		return nil
 	}
 	for i := range testFiles {
-		fsChan <- testDirectory + testFiles[i]
+		events = append(events, fsEvent(testFiles[i]))
 	}
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	time.Sleep(testDebounceTimeout * 50)
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if testOK != 3 {
 		t.Error("Callback not correctly triggered")
 	}
@@ -235,26 +486,24 @@ func TestDebouncedParentDirectoryWatch4(t *testing.T) {
 	defer clearTestDir()
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := 3
-	stChan := make(chan STEvent, 10)
-	fsChan := make(chan string, 10)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
 		}
 		if repo != testRepo || len(sub) != 2 || sub[0] != "a"+slash+"b" {
-			t.Errorf("Invalid result for directory change %t : (%v) %#v", testOK, repo, sub)
+			t.Errorf("Invalid result for directory change %d : (%v) %#v", testOK, repo, sub)
 		}
 		if repo != testRepo || sub[1] != "a"+slash+"e" {
-			t.Errorf("Invalid result for directory change %t : (%v) %#v", testOK, repo, sub)
+			t.Errorf("Invalid result for directory change %d : (%v) %#v", testOK, repo, sub)
 		}
 		testOK = len(sub)
 		return nil
 	}
 	for i := range testFiles {
-		fsChan <- testDirectory + testFiles[i]
+		events = append(events, fsEvent(testFiles[i]))
 	}
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	time.Sleep(testDebounceTimeout * 50)
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if testOK != 2 {
 		t.Error("Callback not correctly triggered")
 	}
@@ -273,8 +522,7 @@ func TestDebouncedParentDirectoryWatch5(t *testing.T) {
 	defer clearTestDir()
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := 3
-	stChan := make(chan STEvent, 10)
-	fsChan := make(chan string, 10)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
@@ -286,10 +534,9 @@ func TestDebouncedParentDirectoryWatch5(t *testing.T) {
 		return nil
 	}
 	for i := range testFiles {
-		fsChan <- testDirectory + testFiles[i]
+		events = append(events, fsEvent(testFiles[i]))
 	}
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	time.Sleep(testDebounceTimeout * 50)
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if !testOK {
 		t.Error("Callback not correctly triggered")
 	}
@@ -308,8 +555,7 @@ func TestDebouncedParentDirectoryWatch6(t *testing.T) {
 	defer clearTestDir()
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := 10
-	stChan := make(chan STEvent, 10)
-	fsChan := make(chan string, 10)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
@@ -321,10 +567,9 @@ func TestDebouncedParentDirectoryWatch6(t *testing.T) {
 		return nil
 	}
 	for i := range testFiles {
-		fsChan <- testDirectory + testFiles[i]
+		events = append(events, fsEvent(testFiles[i]))
 	}
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	time.Sleep(testDebounceTimeout * 50)
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if testOK != 1 {
 		t.Error("Callback not correctly triggered")
 	}
@@ -341,8 +586,7 @@ func TestDebouncedParentDirectoryRemovedWatch(t *testing.T) {
 	clearTestDir()
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := 10
-	stChan := make(chan STEvent, 10)
-	fsChan := make(chan string, 10)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
@@ -354,10 +598,9 @@ func TestDebouncedParentDirectoryRemovedWatch(t *testing.T) {
 		return nil
 	}
 	for i := range testFiles {
-		fsChan <- testDirectory + testFiles[i]
+		events = append(events, fsEvent(testFiles[i]))
 	}
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	time.Sleep(testDebounceTimeout * 50)
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if testOK != 1 {
 		t.Error("Callback not correctly triggered")
 	}
@@ -374,8 +617,7 @@ func TestSTEvents(t *testing.T) {
 	defer clearTestDir()
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := 10
-	stChan := make(chan STEvent, 10)
-	fsChan := make(chan string, 10)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
@@ -386,14 +628,13 @@ func TestSTEvents(t *testing.T) {
 		testOK = false
 		return nil
 	}
-	stChan <- STEvent{Path: ""}
+	events = append(events, stEvent("", false))
 	for i := range testFiles {
-		stChan <- STEvent{Path: testDirectory + testFiles[i], Finished: false}
-		fsChan <- testDirectory + testFiles[i]
-		stChan <- STEvent{Path: testDirectory + testFiles[i], Finished: true}
+		events = append(events, stEvent(testFiles[i], false))
+		events = append(events, fsEvent(testFiles[i]))
+		events = append(events, stEvent(testFiles[i], true))
 	}
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	time.Sleep(testDebounceTimeout * 50)
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if !testOK {
 		t.Error("Callback not correctly triggered")
 	}
@@ -410,9 +651,7 @@ func TestFilesAggregation(t *testing.T) {
 	defer clearTestDir()
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := nrFiles + 1
-	stop := make(chan int, 1)
-	stChan := make(chan STEvent, nrFiles)
-	fsChan := make(chan string, nrFiles)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
@@ -424,15 +663,12 @@ func TestFilesAggregation(t *testing.T) {
 			t.Error("Callback triggered multiple times")
 		}
 		testOK = true
-		stop <- 1
 		return nil
 	}
 	for _, testFile := range testFiles {
-		fsChan <- testDirectory + testFile
+		events = append(events, fsEvent(testFile))
 	}
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	<-stop
-	time.Sleep(testDebounceTimeout * 50)
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if !testOK {
 		t.Error("Callback not triggered")
 	}
@@ -448,29 +684,24 @@ func TestManyFilesAggregation(t *testing.T) {
 	defer clearTestDir()
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := 10
-	stop := make(chan int, 1)
-	stChan := make(chan STEvent, nrFiles)
-	fsChan := make(chan string, nrFiles)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
 		}
-		if repo != testRepo || len(sub) != 1 || sub[0] != "" {
+		if repo != testRepo || len(sub) != 1 || sub[0] != "a" {
 			t.Errorf("Invalid result for directory change: (%v) %#v", repo, sub)
 		}
 		if testOK {
 			t.Error("Callback triggered multiple times")
 		}
 		testOK = true
-		stop <- 1
 		return nil
 	}
 	for _, testFile := range testFiles {
-		fsChan <- testDirectory + testFile
+		events = append(events, fsEvent(testFile))
 	}
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	<-stop
-	time.Sleep(testDebounceTimeout * 50)
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if !testOK {
 		t.Error("Callback not triggered")
 	}
@@ -486,9 +717,7 @@ func TestDeletesAggregation(t *testing.T) {
 	}
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := 10
-	stop := make(chan int, 1)
-	stChan := make(chan STEvent, nrFiles)
-	fsChan := make(chan string, nrFiles)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
@@ -500,15 +729,12 @@ func TestDeletesAggregation(t *testing.T) {
 			t.Error("Callback triggered multiple times")
 		}
 		testOK = true
-		stop <- 1
 		return nil
 	}
 	for _, testFile := range testFiles {
-		fsChan <- testDirectory + testFile
+		events = append(events, fsEvent(testFile))
 	}
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	<-stop
-	time.Sleep(testDebounceTimeout * 50)
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if !testOK {
 		t.Error("Callback not triggered")
 	}
@@ -524,29 +750,24 @@ func TestManyDeletesAggregation(t *testing.T) {
 	}
 	testDebounceTimeout := 100 * time.Millisecond
 	testDirVsFiles := 10
-	stop := make(chan int, 1)
-	stChan := make(chan STEvent, nrFiles)
-	fsChan := make(chan string, nrFiles)
+	var events []recordedEvent
 	fileChange := func(repo string, sub []string) error {
 		if len(sub) == 1 && sub[0] == ".stfolder" {
 			return nil
 		}
-		if repo != testRepo || len(sub) != 1 || sub[0] != "" {
+		if repo != testRepo || len(sub) != 1 || sub[0] != "a" {
 			t.Errorf("Invalid result for directory change: (%v) %#v", repo, sub)
 		}
 		if testOK {
 			t.Error("Callback triggered multiple times")
 		}
 		testOK = true
-		stop <- 1
 		return nil
 	}
 	for _, testFile := range testFiles {
-		fsChan <- testDirectory + testFile
+		events = append(events, fsEvent(testFile))
 	}
-	go accumulateChanges(testDebounceTimeout, testRepo, testDirectory, testDirVsFiles, stChan, fsChan, fileChange)
-	<-stop
-	time.Sleep(testDebounceTimeout * 50)
+	accumulate(testDebounceTimeout, testRepo, testDirVsFiles, events, fileChange)
 	if !testOK {
 		t.Error("Callback not triggered")
 	}
@@ -581,7 +802,7 @@ func TestAggregateChanges(t *testing.T) {
 		}
 	}
 	checkAggregation := func(dirVsFiles int, paths []string, expected []string) {
-		changes := aggregateChanges("/path/to/folder", dirVsFiles, paths, pathStat)
+		changes := aggregateChanges("/path/to/folder", dirVsFiles, paths, pathStat, nil)
 		if !slicesEqual(changes, expected) {
 			t.Errorf("Expected: %#v, got: %#v", expected, changes)
 		}
@@ -600,4 +821,585 @@ func TestAggregateChanges(t *testing.T) {
 	checkAggregation(3, []string{"file1", "file2", "file3", "file4"}, []string{""})
 	checkAggregation(3, []string{"file1", "file2", "file3", "file4",
 		"a"+slash+"file1", "a"+slash+"file2"}, []string{""})
+	// Changes in subdirectories don't count for the folder itself
+	checkAggregation(3, []string{"file1", "a" + slash + "x" + slash + "file1", "a" + slash + "x" + slash + "file2", "a" + slash + "y" + slash + "file3"},
+		[]string{"a" + slash + "x" + slash + "file1", "a" + slash + "x" + slash + "file2", "a" + slash + "y" + slash + "file3", "file1"})
+}
+
+// BenchmarkAggregateChanges aggregates changes of 10 files in each of n/10 directories, 5 levels deep
+func BenchmarkAggregateChanges(b *testing.B) {
+	pathStat := func(path string) PathStatus {
+		return filePath
+	}
+	for _, n := range []int{10000, 100000, 1000000} {
+		paths := make([]string, 0, n)
+		for i := 0; len(paths) < n; i++ {
+			dir := filepath.Join(slash+"folder", fmt.Sprint(i%7), fmt.Sprint(i%11), fmt.Sprint(i%13), fmt.Sprint(i))
+			for j := 0; j < 10; j++ {
+				paths = append(paths, filepath.Join(dir, fmt.Sprintf("file%d", j)))
+			}
+		}
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				// aggregateChanges cleans paths in place
+				aggregateChanges(slash+"folder", dirVsFiles, append([]string(nil), paths...), pathStat, nil)
+			}
+		})
+	}
+}
+
+func TestFoldersChanged(t *testing.T) {
+	folders := []FolderConfiguration{{ID: "a", Path: "/a"}, {ID: "b", Path: "/b"}}
+	changed := func(change func(f *FolderConfiguration)) bool {
+		newFolders := append([]FolderConfiguration(nil), folders...)
+		change(&newFolders[1])
+		return foldersChanged(folders, newFolders)
+	}
+	if changed(func(f *FolderConfiguration) {}) {
+		t.Error("Unchanged folders reported as changed")
+	}
+	if !changed(func(f *FolderConfiguration) { f.Path = "/c" }) {
+		t.Error("Changed path not detected")
+	}
+	// The case folding of paths depends on these
+	if !changed(func(f *FolderConfiguration) { f.AutoNormalize = true }) {
+		t.Error("Changed autoNormalize not detected")
+	}
+	if !changed(func(f *FolderConfiguration) { f.CaseSensitiveFS = true }) {
+		t.Error("Changed caseSensitiveFS not detected")
+	}
+}
+
+func TestFilterFolders(t *testing.T) {
+	var folders []FolderConfiguration
+	err := json.Unmarshal([]byte(`[{"id": "plain", "label": "Plain"},
+		{"id": "watched", "label": "Watched", "fsWatcherEnabled": true},
+		{"id": "paused", "label": "Paused", "paused": true}]`), &folders)
+	if err != nil || len(folders) != 3 || !folders[1].FSWatcherEnabled || !folders[2].Paused {
+		t.Fatalf("Invalid folders %#v (%v)", folders, err)
+	}
+	defer func(f bool) {
+		forceWatch = f
+	}(forceWatch)
+	st := newSTInstance("")
+	ids := func(folders []FolderConfiguration) []string {
+		var ids []string
+		for _, f := range folders {
+			ids = append(ids, f.ID)
+		}
+		return ids
+	}
+	cases := []struct {
+		watch, skip folderSlice
+		force       bool
+		expected    []string
+	}{
+		{nil, nil, false, []string{"plain", "paused"}},
+		{nil, nil, true, []string{"plain", "watched", "paused"}},
+		{folderSlice{"Watched", "paused"}, nil, true, []string{"watched", "paused"}},
+		{folderSlice{"Watched"}, nil, false, nil},
+		{nil, folderSlice{"Plain", "Paused"}, true, []string{"watched"}},
+		{folderSlice{"*a*"}, folderSlice{"re:pause."}, true, []string{"plain", "watched"}},
+	}
+	for _, c := range cases {
+		st.watchFolders, st.skipFolders, forceWatch = c.watch, c.skip, c.force
+		if fs := ids(st.filterFolders(folders)); !slicesEqual(fs, c.expected) {
+			t.Errorf("Expected %v for -folders %v -skip-folders %v -force-watch=%t, got %v", c.expected, c.watch, c.skip, c.force, fs)
+		}
+	}
+}
+
+func TestMatchFolder(t *testing.T) {
+	f := FolderConfiguration{ID: "abcd-1234", Label: "proj-web", Path: filepath.Join(slash+"data", "scratch", "web")}
+	cases := []struct {
+		pattern  string
+		expected bool
+	}{
+		{"proj-web", true},
+		{"abcd-1234", true},
+		{"proj", false},
+		{"proj-*", true},
+		{"scratch-*", false},
+		{"abcd-????", true},
+		{filepath.Join(slash+"data", "scratch", "*"), true},
+		{filepath.Join(slash+"data", "*"), false},
+		{"*", true},
+		{"re:proj-(web|app)", true},
+		{"re:proj", false},
+		{"re:.*/scratch/.*", filepath.Separator == '/'},
+		{"re:[0-9]{4}", false},
+	}
+	for _, c := range cases {
+		if ok, err := matchFolder(c.pattern, f); err != nil || ok != c.expected {
+			t.Errorf("Expected %t for pattern %s, got %t (%v)", c.expected, c.pattern, ok, err)
+		}
+	}
+	for _, pattern := range []string{"[", "re:("} {
+		if _, err := matchFolder(pattern, f); err == nil {
+			t.Errorf("Invalid pattern %s accepted", pattern)
+		}
+	}
+	var fs folderSlice
+	if err := fs.Set("a,b*"); err != nil || !slicesEqual(fs, []string{"a", "b*"}) {
+		t.Errorf("Expected globs to be split at commas, got %v (%v)", fs, err)
+	}
+	if err := fs.Set("re:x{1,2}"); err != nil || len(fs) != 3 || fs[2] != "re:x{1,2}" {
+		t.Errorf("Expected a single regular expression, got %v (%v)", fs, err)
+	}
+}
+
+func TestPausedFolder(t *testing.T) {
+	// Changes of paused folders are dropped, as Syncthing scans folders when they are resumed
+	testFiles := createTestPaths(t, "file1", "file2")
+	defer clearTestDir()
+	clock := &virtualClock{now: time.Now()}
+	var requests [][]string
+	a := newChangeAccumulator(clock, 100*time.Millisecond, "test1", testDirectory, 10, func(string, []string) error {
+		return nil
+	})
+	a.startScan = func(id int, subs []string) {
+		requests = append(requests, subs)
+	}
+	a.fsEvent(testFiles[0])
+	clock.now = clock.now.Add(200 * time.Millisecond)
+	a.flush()
+	a.scanFinished(1, errors.New("folder is paused"))
+	a.stEvent(STEvent{Paused: true})
+	a.fsEvent(testFiles[1])
+	clock.now = clock.now.Add(time.Minute)
+	a.flush()
+	if len(requests) != 1 || len(a.inProgress) != 0 || a.scan != nil || !a.retryTime.IsZero() {
+		t.Fatalf("Changes of paused folder not dropped: %v, %v", requests, a.inProgress)
+	}
+	a.stEvent(STEvent{Resumed: true})
+	a.fsEvent(testFiles[1])
+	clock.now = clock.now.Add(200 * time.Millisecond)
+	a.flush()
+	if len(requests) != 2 || !slicesEqual(requests[1], testFiles[1:]) {
+		t.Errorf("Expected a scan of %v after resuming, got %v", testFiles[1:], requests)
+	}
+}
+
+func TestDebounceTimeoutFor(t *testing.T) {
+	defer func(d, r time.Duration) {
+		debounceTimeout, receiveOnlyTimeout = d, r
+	}(debounceTimeout, receiveOnlyTimeout)
+	debounceTimeout, receiveOnlyTimeout = time.Second, 10*time.Second
+	cases := map[string]time.Duration{
+		"":            time.Second,
+		"sendreceive": time.Second,
+		"sendonly":    time.Second,
+		"receiveonly": 10 * time.Second,
+	}
+	for folderType, expected := range cases {
+		if interval := debounceTimeoutFor(FolderConfiguration{Type: folderType}); interval != expected {
+			t.Errorf("Expected %v for %q, got %v", expected, folderType, interval)
+		}
+	}
+	debounceTimeout = time.Minute
+	if interval := debounceTimeoutFor(FolderConfiguration{Type: "receiveonly"}); interval != time.Minute {
+		t.Errorf("Expected -interval when longer than -receive-only-interval, got %v", interval)
+	}
+}
+
+func TestAdaptiveInterval(t *testing.T) {
+	// A burst of changes is accumulated for longer, an isolated change is informed about quickly
+	testFiles := createTestPaths(t, "file1", "file2", "file3", "file4", "file5")
+	defer clearTestDir()
+	defer func(m time.Duration, d int) {
+		maxDebounceTimeout, delayScan = m, d
+	}(maxDebounceTimeout, delayScan)
+	delayScan = 0
+	replay := func(max time.Duration) []string {
+		maxDebounceTimeout = max
+		clock := &virtualClock{now: time.Now()}
+		start := clock.now
+		var scans []string
+		a := newChangeAccumulator(clock, 100*time.Millisecond, "test1", testDirectory, 10, func(folder string, subs []string) error {
+			scans = append(scans, fmt.Sprint(clock.Now().Sub(start), subs))
+			return nil
+		})
+		var events []recordedEvent
+		for i, f := range testFiles {
+			ev := fsEvent(f)
+			ev.Time = start.Add(time.Duration(i) * 80 * time.Millisecond)
+			events = append(events, ev)
+		}
+		isolated := fsEvent(testFiles[0])
+		isolated.Time = start.Add(3 * time.Second)
+		runAccumulator(a, clock, append(events, isolated), time.Time{})
+		return scans
+	}
+	if scans := replay(0); len(scans) < 4 {
+		t.Errorf("Expected a scan for almost every change with a fixed interval, got %v", scans)
+	}
+	expected := []string{"640ms [file1 file2 file3 file4]", "960ms [file5]", "3.2s [file1]"}
+	if scans := replay(time.Second); !slicesEqual(scans, expected) {
+		t.Errorf("Expected %v, got %v", expected, scans)
+	}
+	expected = []string{"440ms [file1 file2 file3]", "640ms [file4 file5]", "3.2s [file1]"}
+	if scans := replay(200 * time.Millisecond); !slicesEqual(scans, expected) {
+		t.Errorf("Expected scans at most every 200ms with -max-interval=200ms, got %v", scans)
+	}
+}
+
+func TestMaxWait(t *testing.T) {
+	// A path which changes continuously is informed about after maxWait, hot paths every hotInterval
+	testFiles := createTestPaths(t, "db", "app.log")
+	defer clearTestDir()
+	defer func(w, h time.Duration, p []string, d int) {
+		maxWait, hotInterval, hotPaths, delayScan = w, h, p, d
+	}(maxWait, hotInterval, hotPaths, delayScan)
+	maxWait, hotInterval, hotPaths, delayScan = time.Second, 2*time.Second, []string{"*.log"}, 0
+	clock := &virtualClock{now: time.Now()}
+	start := clock.now
+	var scans []string
+	a := newChangeAccumulator(clock, 100*time.Millisecond, "test1", testDirectory, 10, func(folder string, subs []string) error {
+		scans = append(scans, fmt.Sprint(clock.Now().Sub(start), subs))
+		return nil
+	})
+	var events []recordedEvent
+	for i := 0; i < 50; i++ {
+		for _, f := range testFiles {
+			ev := fsEvent(f)
+			ev.Time = start.Add(time.Duration(i) * 50 * time.Millisecond)
+			events = append(events, ev)
+		}
+	}
+	runAccumulator(a, clock, events, time.Time{})
+	// db is informed about again once it stopped changing, app.log only at its cadence
+	expected := []string{"1s [db]", "2s [app.log]", "2.1s [db]", "2.6s [db]", "4.1s [app.log]"}
+	if !slicesEqual(scans, expected) {
+		t.Errorf("Expected %v, got %v", expected, scans)
+	}
+	if isHotPath("a"+slash+"app.log.1") || !isHotPath("a"+slash+"app.log") {
+		t.Error("Hot path patterns without separator do not match file names")
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// A file which is written for a long time is informed about once, after its writer closed it
+	testFiles := createTestPaths(t, "copy", "stuck", "other")
+	defer clearTestDir()
+	defer func(w, wt time.Duration, d int) {
+		maxWait, writeTimeout, delayScan = w, wt, d
+	}(maxWait, writeTimeout, delayScan)
+	maxWait, writeTimeout, delayScan = time.Second, 5*time.Second, 0
+	clock := &virtualClock{now: time.Now()}
+	start := clock.now
+	var scans []string
+	a := newChangeAccumulator(clock, 100*time.Millisecond, "test1", testDirectory, 10, func(folder string, subs []string) error {
+		scans = append(scans, fmt.Sprint(clock.Now().Sub(start), subs))
+		return nil
+	})
+	event := func(path string, at time.Duration, writing bool, closed bool) recordedEvent {
+		ev := fsEvent(path)
+		ev.Time, ev.Writing, ev.Closed = start.Add(at), writing, closed
+		return ev
+	}
+	events := []recordedEvent{event(testFiles[1], 0, true, false), event(testFiles[2], 0, false, false)}
+	// Pauses between writes are longer than the interval
+	for i := 0; i < 10; i++ {
+		events = append(events, event(testFiles[0], time.Duration(i)*300*time.Millisecond, true, false))
+	}
+	events = append(events, event(testFiles[0], 3*time.Second, false, true))
+	runAccumulator(a, clock, events, time.Time{})
+	// The copy waited longer than maxWait already, so it is informed about right when it is closed
+	expected := []string{"200ms [other]", "3s [copy]", "5s [stuck]"}
+	if !slicesEqual(scans, expected) {
+		t.Errorf("Expected %v, got %v", expected, scans)
+	}
+}
+
+func TestOverflowSummary(t *testing.T) {
+	// Changes beyond maxFiles are scanned by the smallest directories covering them
+	var files []string
+	for i := 0; i < 10; i++ {
+		files = append(files, "a"+slash+"b"+slash+"c"+slash+"d"+slash+"file"+strconv.Itoa(i))
+	}
+	files = append(files, "x"+slash+"file")
+	createTestPaths(t, files...)
+	defer clearTestDir()
+	defer func(m int, d int) {
+		maxFiles, delayScan = m, d
+	}(maxFiles, delayScan)
+	maxFiles, delayScan = 4, 0
+	clock := &virtualClock{now: time.Now()}
+	var requests [][]string
+	a := newChangeAccumulator(clock, 100*time.Millisecond, "test1", testDirectory, 10, func(folder string, subs []string) error {
+		requests = append(requests, subs)
+		return nil
+	})
+	var events []recordedEvent
+	for _, f := range files {
+		events = append(events, fsEvent(f))
+	}
+	runAccumulator(a, clock, events, time.Time{})
+	expected := []string{"a" + slash + "b" + slash + "c", "x" + slash + "file"}
+	if len(requests) != 1 || !slicesEqual(requests[0], expected) {
+		t.Errorf("Expected a scan of %v, got %v", expected, requests)
+	}
+	if len(a.inProgress) != 0 || len(a.overflow) != 0 {
+		t.Errorf("Changes still tracked after they were scanned: %v %v", a.inProgress, a.overflow)
+	}
+	if p := cutPath(testDirectory+"a"+slash+"b"+slash+"c", testDirectory, 2); p != testDirectory+"a"+slash+"b" {
+		t.Errorf("Expected the path to be cut to a/b, got %s", p)
+	}
+}
+
+func TestOverflowOnlyScan(t *testing.T) {
+	// A scan of overflow directories alone does not cover the tracked changes which are not due yet
+	files := []string{"file1", "file2", "a" + slash + "b" + slash + "c" + slash + "d" + slash + "file3"}
+	createTestPaths(t, files...)
+	defer clearTestDir()
+	defer func(m int, d int) {
+		maxFiles, delayScan = m, d
+	}(maxFiles, delayScan)
+	maxFiles, delayScan = 1, 0
+	clock := &virtualClock{now: time.Now()}
+	var requests [][]string
+	a := newChangeAccumulator(clock, 100*time.Millisecond, "test1", testDirectory, 10, func(folder string, subs []string) error {
+		requests = append(requests, subs)
+		return nil
+	})
+	for _, f := range files {
+		a.fsEvent(f)
+	}
+	// Only the overflow directory is due at the next flush
+	clock.now = clock.now.Add(150 * time.Millisecond)
+	a.fsEvent(files[0])
+	a.fsEvent(files[1])
+	clock.now = clock.now.Add(50 * time.Millisecond)
+	a.flush()
+	expected := []string{"a" + slash + "b" + slash + "c"}
+	if len(requests) != 1 || !slicesEqual(requests[0], expected) {
+		t.Fatalf("Expected a scan of %v, got %v", expected, requests)
+	}
+	if len(a.inProgress) != 2 || len(a.overflow) != 0 {
+		t.Errorf("Expected file1 and file2 to be tracked, got %v %v", a.inProgress, a.overflow)
+	}
+}
+
+func TestSplitScan(t *testing.T) {
+	defer func(m int, d int) {
+		maxScanURLLength, delayScan = m, d
+	}(maxScanURLLength, delayScan)
+	delayScan = 0
+	maxScanURLLength = len(scanURL("f", nil)) + len("&sub=ab")*2
+	chunks := splitScan("f", []string{"ab", "cd", "ef", "a long sub", "gh"})
+	expected := [][]string{{"ab", "cd"}, {"ef"}, {"a long sub"}, {"gh"}}
+	if len(chunks) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, chunks)
+	}
+	for i := range chunks {
+		if !slicesEqual(chunks[i], expected[i]) {
+			t.Errorf("Expected %v, got %v", expected, chunks)
+		}
+	}
+	for _, chunk := range chunks {
+		if l := len(scanURL("f", chunk)); l > maxScanURLLength && len(chunk) > 1 {
+			t.Errorf("Request for %v is %d long", chunk, l)
+		}
+	}
+}
+
+func TestSplitScanRetry(t *testing.T) {
+	// Only the chunks which failed are requested again
+	var files []string
+	for i := 0; i < 9; i++ {
+		files = append(files, "file"+strconv.Itoa(i))
+	}
+	createTestPaths(t, files...)
+	defer clearTestDir()
+	defer func(m int, d int) {
+		maxScanURLLength, delayScan = m, d
+	}(maxScanURLLength, delayScan)
+	delayScan = 0
+	maxScanURLLength = len(scanURL("test1", nil)) + len("&sub=file0")*3
+	clock := &virtualClock{now: time.Now()}
+	var requests [][]string
+	a := newChangeAccumulator(clock, 100*time.Millisecond, "test1", testDirectory, 10, func(folder string, subs []string) error {
+		requests = append(requests, subs)
+		if len(requests) == 2 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	var events []recordedEvent
+	for _, f := range files {
+		events = append(events, fsEvent(f))
+	}
+	runAccumulator(a, clock, events, time.Time{})
+	expected := [][]string{
+		{"file0", "file1", "file2"},
+		{"file3", "file4", "file5"},
+		{"file3", "file4", "file5"},
+		{"file6", "file7", "file8"},
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("Expected requests %v, got %v", expected, requests)
+	}
+	for i := range requests {
+		if !slicesEqual(requests[i], expected[i]) {
+			t.Errorf("Expected requests %v, got %v", expected, requests)
+		}
+	}
+	if len(a.inProgress) != 0 {
+		t.Errorf("Changes still tracked after they were scanned: %v", a.inProgress)
+	}
+}
+
+func TestSpecialFileNames(t *testing.T) {
+	// Paths reach the scan request byte-identical
+	files := []string{"new\nline", "invalid\xff\xfe", "~" + slash + "file", "~b", "a&sub=b", "a+b c", "100%", "a?b#c",
+		"日本語" + slash + "😀", "esc\x1b[0m"}
+	createTestPaths(t, files...)
+	defer clearTestDir()
+	defer func(d int) {
+		delayScan = d
+	}(delayScan)
+	delayScan = 0
+	clock := &virtualClock{now: time.Now()}
+	var subs []string
+	a := newChangeAccumulator(clock, 100*time.Millisecond, "test1", testDirectory, 100, func(folder string, s []string) error {
+		subs = append(subs, s...)
+		return nil
+	})
+	var events []recordedEvent
+	for _, f := range files {
+		events = append(events, fsEvent(f))
+		if p := relativePath(testDirectory+f, testDirectory); p != f {
+			t.Errorf("Expected relative path %q, got %q", f, p)
+		}
+		if p := relativePath(f, testDirectory); p != f {
+			t.Errorf("Expected relative path %q to be kept, got %q", f, p)
+		}
+	}
+	runAccumulator(a, clock, events, time.Time{})
+	sort.Strings(files)
+	sort.Strings(subs)
+	if !slicesEqual(subs, files) {
+		t.Errorf("Expected scan of %q, got %q", files, subs)
+	}
+}
+
+func TestEchoSuppressionNormalized(t *testing.T) {
+	// Syncthing reports café in NFC, the filesystem in NFD
+	nfc, nfd := "caf\u00e9", "cafe\u0301"
+	createTestPaths(t, nfd, "Upper.txt")
+	defer clearTestDir()
+	defer func(d int) {
+		delayScan = d
+	}(delayScan)
+	delayScan = 0
+	cases := []struct {
+		normalize, caseInsensitive bool
+		expected                   []string
+	}{
+		{false, false, []string{"Upper.txt", nfd}},
+		{true, false, []string{"Upper.txt"}},
+		{true, true, nil},
+	}
+	for _, c := range cases {
+		clock := &virtualClock{now: time.Now()}
+		var subs []string
+		a := newChangeAccumulator(clock, 100*time.Millisecond, "test1", testDirectory, 10, func(folder string, s []string) error {
+			subs = append(subs, s...)
+			return nil
+		})
+		a.pathKey = pathKeyFor(c.normalize, c.caseInsensitive)
+		runAccumulator(a, clock, []recordedEvent{
+			stEvent(nfc, false),
+			stEvent("upper.txt", false),
+			fsEvent(nfd),
+			fsEvent("Upper.txt"),
+		}, time.Time{})
+		sort.Strings(subs)
+		if !slicesEqual(subs, c.expected) && len(subs)+len(c.expected) > 0 {
+			t.Errorf("Normalize %t, case insensitive %t: expected a scan of %q, got %q", c.normalize, c.caseInsensitive, c.expected, subs)
+		}
+	}
+}
+
+func TestCaseInsensitiveFS(t *testing.T) {
+	createTestPaths(t, "Probe", "123"+slash+"456")
+	defer clearTestDir()
+	// Filesystems are case insensitive by default on Windows and macOS only
+	expected := runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+	if insensitive := caseInsensitiveFS(testDirectory); insensitive != expected {
+		t.Errorf("Expected case insensitive %t, got %t", expected, insensitive)
+	}
+	// Without letters in names there is nothing to probe
+	if caseInsensitiveFS(testDirectory + "123") {
+		t.Error("Filesystem assumed to be case insensitive without any letters to probe")
+	}
+	if s := swapCase("aBc-Ä"); s != "AbC-ä" {
+		t.Errorf("Expected swapped case AbC-ä, got %s", s)
+	}
+}
+
+func TestRelativePath(t *testing.T) {
+	p := filepath.FromSlash
+	cases := []struct {
+		path, folderPath, expected string
+	}{
+		{p("/data/a/x"), p("/data/a"), "x"},
+		{p("/data/a/x/y"), p("/data/a/"), p("x/y")},
+		{p("/data/a"), p("/data/a"), ""},
+		{p("/data/a/"), p("/data/a"), ""},
+		{p("/data/ab/x"), p("/data/a"), p("/data/ab/x")},
+		{p("/data/ab"), p("/data/a"), p("/data/ab")},
+		{p("/x"), p("/"), "x"},
+		{p("x/y"), p("/data/a"), p("x/y")},
+		{p("~/x"), p("/data/a"), p("~/x")},
+	}
+	for _, c := range cases {
+		if relPath := relativePath(c.path, c.folderPath); relPath != c.expected {
+			t.Errorf("Expected %s in %s to be %q, got %q", c.path, c.folderPath, c.expected, relPath)
+		}
+	}
+}
+
+func TestFolderRelativePath(t *testing.T) {
+	createTestPaths(t, "real"+slash+"sub"+slash+"file", "realx"+slash+"file")
+	defer clearTestDir()
+	if err := os.Symlink(testDirectory+"real", testDirectory+"link"); err != nil {
+		t.Skip("Symlinks are not supported", err)
+	}
+	folderPath, err := realPath(testDirectory + "real")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path, expected string
+		ok             bool
+	}{
+		{folderPath + slash + "sub" + slash + "file", "sub" + slash + "file", true},
+		{testDirectory + "link" + slash + "sub" + slash + "file", "sub" + slash + "file", true},
+		{testDirectory + "link" + slash + "deleted", "deleted", true},
+		{testDirectory + "link", "", true},
+		{testDirectory + "realx" + slash + "file", "", false},
+		{testDirectory + "other" + slash + "file", "", false},
+	}
+	for _, c := range cases {
+		if relPath, ok := folderRelativePath(c.path, folderPath); relPath != c.expected || ok != c.ok {
+			t.Errorf("Expected %s to be %q (%t), got %q (%t)", c.path, c.expected, c.ok, relPath, ok)
+		}
+	}
+	// Relative paths are resolved against the folder, not the working directory
+	if status := folderPathStatus(folderPath)("sub"); status != directoryPath {
+		t.Errorf("Expected sub to be a directory, got %v", status)
+	}
+	// A relative folder root is resolved against the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relRoot, err := filepath.Rel(wd, folderPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := folderPathStatus(relRoot)("sub"); status != directoryPath {
+		t.Errorf("Expected sub in %s to be a directory, got %v", relRoot, status)
+	}
 }
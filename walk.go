@@ -0,0 +1,32 @@
+// walk.go
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// errStopWalk is returned by the function passed to walkBelow to stop walking
+var errStopWalk = errors.New("walk stopped")
+
+// walkBelow calls fn for every file and directory below dir with its path relative to dir. fn can
+// return filepath.SkipDir to skip a directory or errStopWalk to stop walking. Paths which cannot be
+// read are skipped, as files can be removed while walking. stopped reports whether fn stopped
+// walking, err is only set if dir itself cannot be read.
+func walkBelow(dir string, fn func(relPath string, info os.FileInfo) error) (stopped bool, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if path == dir {
+			return err
+		}
+		if err != nil {
+			return nil
+		}
+		relPath, _ := trimFolder(path, dir)
+		return fn(relPath, info)
+	})
+	if err == errStopWalk {
+		return true, nil
+	}
+	return false, err
+}
@@ -0,0 +1,38 @@
+// walk_test.go
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWalkBelow(t *testing.T) {
+	createTestPaths(t, "a"+slash+"file1", "b"+slash+"file2", "file3")
+	defer clearTestDir()
+	var walked []string
+	stopped, err := walkBelow(testDirectory, func(relPath string, info os.FileInfo) error {
+		walked = append(walked, relPath)
+		if relPath == "b" {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	expected := []string{"a", "a" + slash + "file1", "b", "file3"}
+	if stopped || err != nil || !slicesEqual(walked, expected) {
+		t.Errorf("Expected to walk %v, walked %v (stopped %t, %v)", expected, walked, stopped, err)
+	}
+
+	walked = nil
+	stopped, err = walkBelow(testDirectory, func(relPath string, info os.FileInfo) error {
+		walked = append(walked, relPath)
+		return errStopWalk
+	})
+	if !stopped || err != nil || len(walked) != 1 {
+		t.Errorf("Expected to stop after the first path, walked %v (stopped %t, %v)", walked, stopped, err)
+	}
+
+	if _, err := walkBelow(testDirectory+"missing", func(string, os.FileInfo) error { return nil }); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+}
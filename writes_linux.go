@@ -0,0 +1,14 @@
+// +build linux
+
+package main
+
+import "github.com/zillode/notify"
+
+// writeEvents are watched in addition to notify.All with -write-timeout. IN_OPEN is not
+// needed as it does not tell writers from readers, the first write raises IN_MODIFY.
+var writeEvents = []notify.Event{notify.InModify, notify.InCloseWrite}
+
+// writeState tells whether ev is a write to a file or the close of a file by its writer
+func writeState(ev notify.Event) (writing bool, closed bool) {
+	return ev == notify.InModify || ev == notify.Write, ev == notify.InCloseWrite
+}
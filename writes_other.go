@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+import "github.com/zillode/notify"
+
+// writeEvents is empty as writers can only be told apart on Linux
+var writeEvents []notify.Event
+
+func writeState(ev notify.Event) (writing bool, closed bool) {
+	return false, false
+}